@@ -2,13 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/spf13/cobra"
+	"io/fs"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
-	"runtime"
 	"strings"
 
 	"go.uber.org/zap"
@@ -19,6 +20,8 @@ import (
 
 var log *zap.SugaredLogger
 var imagesDir string
+var serveProfiles bool
+var serveMetrics bool
 
 func logRequestHandler(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -30,14 +33,33 @@ func logRequestHandler(h http.Handler) http.Handler {
 func internalError(w http.ResponseWriter, text string, format string, a ...any) {
 	formatResult := fmt.Sprintf(format, a...)
 
-	log.Errorf("%s%s", formatResult)
+	log.Errorf("%s%s", text, formatResult)
 
 	http.Error(w, text, http.StatusInternalServerError)
 }
 
+// lockMetadata waits until lxdocker is done writing metadata. lxdocker creates
+// the lock file before it writes any, so if there's none, there's no writer
+// yet. We don't create it ourselves, so `--lxdimages` can be read-only.
+func lockMetadata() (*common.FileLock, error) {
+	lock, err := common.LockExistingFile(filepath.Join(imagesDir, common.MetadataLockFilename), false, true)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &common.FileLock{}, nil
+	}
+
+	return lock, err
+}
+
 func indexJsonHandler(w http.ResponseWriter, r *http.Request) {
 	var products []string
 
+	lock, err := lockMetadata()
+	if err != nil {
+		internalError(w, "failed to lock metadata", ": %v", err)
+		return
+	}
+	defer lock.Unlock()
+
 	files, err := ioutil.ReadDir(imagesDir)
 	if err != nil {
 		internalError(w, "failed to open images dir", " `%s`: %v", imagesDir, err)
@@ -77,6 +99,13 @@ func indexJsonHandler(w http.ResponseWriter, r *http.Request) {
 func imagesJsonHandler(w http.ResponseWriter, r *http.Request) {
 	var productMap = map[string]simplestreams.Product{}
 
+	lock, err := lockMetadata()
+	if err != nil {
+		internalError(w, "failed to lock metadata", ": %v", err)
+		return
+	}
+	defer lock.Unlock()
+
 	files, err := ioutil.ReadDir(imagesDir)
 	if err != nil {
 		internalError(w, "failed to open images dir", " `%s`: %v", imagesDir, err)
@@ -93,7 +122,8 @@ func imagesJsonHandler(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 
-		name := strings.TrimSuffix(filepath.Base(file.Name()), ext)
+		// every platform of a spec is a product of its own
+		productName := strings.TrimSuffix(filepath.Base(file.Name()), ext)
 		metadataPath := filepath.Join(imagesDir, file.Name())
 
 		metadataInfo, err := os.Stat(metadataPath)
@@ -108,30 +138,66 @@ func imagesJsonHandler(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 
-		rootfsInfo, err := os.Stat(filepath.Join(imagesDir, metadata.Filename))
+		name := metadata.SpecName(metadataPath)
+
+		platform, err := metadata.ParsePlatform()
 		if err != nil {
-			log.Errorf("failed to stat `%s`: %w", metadata.Filename, err)
+			log.Errorf("invalid platform in `%s`: %v", file.Name(), err)
 			continue
 		}
 
-		versionName := fmt.Sprintf("%s_%s", metadataInfo.ModTime().Format("20060102"), metadata.LxdImageDigest.Hex[:12])
-		productMap[name] = simplestreams.Product{
-			Aliases:         fmt.Sprintf("%s/current/default,%s/current,%s", name, name, name),
-			Architecture:    runtime.GOARCH,
-			OperatingSystem: fmt.Sprintf("docker:%s", name),
-			ReleaseTitle:    "latest",
-			Versions: map[string]simplestreams.ProductVersion{
-				versionName: simplestreams.ProductVersion{
-					Items: map[string]simplestreams.ProductVersionItem{
-						"lxd_combined.tar.gz": simplestreams.ProductVersionItem{
-							FileType:   "lxd_combined.tar.gz",
-							HashSha256: metadata.LxdImageDigest.Hex,
-							Path:       filepath.Join("images", metadata.Filename),
-							Size:       rootfsInfo.Size(),
-						},
+		architecture, err := common.LxdArchitecture(*platform)
+		if err != nil {
+			log.Errorf("unsupported platform in `%s`: %v", file.Name(), err)
+			continue
+		}
+
+		versions := map[string]simplestreams.ProductVersion{}
+		for _, version := range metadata.Versions() {
+			rootfsInfo, err := os.Stat(filepath.Join(imagesDir, version.Filename))
+			if err != nil {
+				log.Errorf("failed to stat `%s`: %w", version.Filename, err)
+				continue
+			}
+
+			// metadata of older lxdocker versions doesn't contain a date
+			created := version.Created
+			if created.IsZero() {
+				created = metadataInfo.ModTime()
+			}
+
+			versionName := fmt.Sprintf("%s_%s", created.UTC().Format("20060102_1504"), version.LxdImageDigest.Hex[:12])
+			versions[versionName] = simplestreams.ProductVersion{
+				Items: map[string]simplestreams.ProductVersionItem{
+					"lxd_combined.tar.gz": simplestreams.ProductVersionItem{
+						FileType:   "lxd_combined.tar.gz",
+						HashSha256: version.LxdImageDigest.Hex,
+						Path:       filepath.Join("images", version.Filename),
+						Size:       rootfsInfo.Size(),
 					},
 				},
-			},
+				// the tag selected by the tag policy of the spec
+				Label: version.Tag,
+			}
+		}
+
+		if len(versions) == 0 {
+			continue
+		}
+
+		releaseTitle := "latest"
+		if metadata.Tag != "" {
+			releaseTitle = metadata.Tag
+		}
+
+		// LXD picks the product of the right architecture for an alias
+		productMap[productName] = simplestreams.Product{
+			Aliases:         fmt.Sprintf("%s/current/default,%s/current,%s", name, name, name),
+			Architecture:    architecture,
+			OperatingSystem: fmt.Sprintf("docker:%s", name),
+			ReleaseTitle:    releaseTitle,
+			Version:         metadata.Tag,
+			Versions:        versions,
 		}
 	}
 
@@ -165,10 +231,77 @@ func rootfsJsonHandler(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, filepath.Join(imagesDir, filename))
 }
 
+func profileHandler(w http.ResponseWriter, r *http.Request) {
+	pathComponents := strings.Split(r.URL.Path, "/")
+	if len(pathComponents) != 3 || pathComponents[0] != "" || pathComponents[1] != "profiles" {
+		log.Errorf("unsupported profile path: `%s`", r.URL.Path)
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+
+	filename := pathComponents[2]
+
+	ext := filepath.Ext(filename)
+	if ext != ".yaml" {
+		log.Errorf("unsupported profile path: `%s`", r.URL.Path)
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+
+	profilePath, err := findProfile(strings.TrimSuffix(filename, ext))
+	if err != nil {
+		internalError(w, "failed to find profile", ": %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/yaml")
+	http.ServeFile(w, r, profilePath)
+}
+
+// findProfile returns the path of the profile of a product. Multi-platform
+// specs have a product per platform, so if there's no product called `name`,
+// it returns the profile of the first product of the spec `name`.
+func findProfile(name string) (string, error) {
+	profilePath := filepath.Join(imagesDir, name+".profile")
+	if _, err := os.Stat(profilePath); err == nil {
+		return profilePath, nil
+	}
+
+	lock, err := lockMetadata()
+	if err != nil {
+		return "", fmt.Errorf("failed to lock metadata: %w", err)
+	}
+	defer lock.Unlock()
+
+	files, err := ioutil.ReadDir(imagesDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to open images dir `%s`: %w", imagesDir, err)
+	}
+
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".meta" {
+			continue
+		}
+
+		metadataPath := filepath.Join(imagesDir, file.Name())
+		metadata, err := common.ReadRootfsMetaData(metadataPath)
+		if err != nil || metadata.SpecName(metadataPath) != name {
+			continue
+		}
+
+		return strings.TrimSuffix(metadataPath, ".meta") + ".profile", nil
+	}
+
+	// let ServeFile respond with a 404
+	return profilePath, nil
+}
+
 func wildcardRequestHandler(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if strings.HasPrefix(r.URL.Path, "/images/") {
 			rootfsJsonHandler(w, r)
+		} else if serveProfiles && strings.HasPrefix(r.URL.Path, "/profiles/") {
+			profileHandler(w, r)
 		} else {
 			h.ServeHTTP(w, r)
 		}
@@ -179,6 +312,7 @@ func main() {
 	log = common.MakeLogger()
 
 	var address string
+	var metricsAddress string
 	var key string
 	var cert string
 
@@ -189,8 +323,23 @@ func main() {
 			http.HandleFunc("/streams/v1/index.json", indexJsonHandler)
 			http.HandleFunc("/streams/v1/images.json", imagesJsonHandler)
 
+			if serveMetrics {
+				http.HandleFunc("/metrics", metricsHandler)
+			}
+			if metricsAddress != "" {
+				metricsMux := http.NewServeMux()
+				metricsMux.HandleFunc("/metrics", metricsHandler)
+
+				go func() {
+					log.Infof("Start metrics server at %s", metricsAddress)
+					err := http.ListenAndServe(metricsAddress, metricsMux)
+					log.Fatalf("metrics listener returned: %v", err)
+				}()
+			}
+
 			var handler http.Handler = http.DefaultServeMux
 			handler = wildcardRequestHandler(handler)
+			handler = metricsRequestHandler(handler)
 			handler = logRequestHandler(handler)
 
 			log.Infof("Start server at %s", address)
@@ -204,6 +353,9 @@ func main() {
 
 	rootCmd.Flags().StringVar(&address, "address", ":443", "server listener address")
 	rootCmd.Flags().StringVar(&imagesDir, "lxdimages", "", "path to directory of generated LXD images")
+	rootCmd.Flags().BoolVar(&serveProfiles, "profiles", false, "serve the generated LXD profiles at /profiles/NAME.yaml")
+	rootCmd.Flags().BoolVar(&serveMetrics, "metrics", false, "serve /metrics at the main address")
+	rootCmd.Flags().StringVar(&metricsAddress, "metrics-address", "", "serve /metrics at this address without TLS")
 	rootCmd.Flags().StringVar(&key, "key", "", "path to TLS key")
 	rootCmd.Flags().StringVar(&cert, "cert", "", "path to TLS certificate")
 
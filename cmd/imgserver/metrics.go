@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"pkg/common"
+)
+
+// upper bounds of the request duration histogram. Downloading a rootfs can
+// take minutes.
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+type histogram struct {
+	// not cumulative, that's done when writing them
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+func (h *histogram) observe(value float64) {
+	if h.buckets == nil {
+		h.buckets = make([]uint64, len(durationBuckets))
+	}
+
+	for i, bound := range durationBuckets {
+		if value <= bound {
+			h.buckets[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+type requestKey struct {
+	handler string
+	code    int
+}
+
+// serverMetrics is what imgserver exports at /metrics, in addition to the
+// metrics it reads from the metadata on every scrape
+type serverMetrics struct {
+	mutex       sync.Mutex
+	requests    map[requestKey]uint64
+	durations   map[string]*histogram
+	servedBytes map[string]uint64
+}
+
+var metrics = serverMetrics{
+	requests:    map[requestKey]uint64{},
+	durations:   map[string]*histogram{},
+	servedBytes: map[string]uint64{},
+}
+
+func (m *serverMetrics) observeRequest(handler string, code int, duration time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.requests[requestKey{handler, code}]++
+
+	h, ok := m.durations[handler]
+	if !ok {
+		h = &histogram{}
+		m.durations[handler] = h
+	}
+	h.observe(duration.Seconds())
+}
+
+func (m *serverMetrics) addServedBytes(product string, n int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.servedBytes[product] += uint64(n)
+}
+
+// responseRecorder remembers the status code and size of a response
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// ReadFrom keeps http.ServeFile from losing sendfile because of the wrapper
+func (r *responseRecorder) ReadFrom(src io.Reader) (int64, error) {
+	n, err := io.Copy(r.ResponseWriter, src)
+	r.bytes += n
+	return n, err
+}
+
+// handlerName groups requests for the metrics
+func handlerName(path string) string {
+	switch {
+	case path == "/streams/v1/index.json":
+		return "index"
+	case path == "/streams/v1/images.json":
+		return "images"
+	case serveMetrics && path == "/metrics":
+		return "metrics"
+	case strings.HasPrefix(path, "/images/"):
+		return "rootfs"
+	case serveProfiles && strings.HasPrefix(path, "/profiles/"):
+		return "profile"
+	default:
+		return "other"
+	}
+}
+
+// rootfsProduct returns the product of `/images/STEM-HASH.rootfs`
+func rootfsProduct(path string) string {
+	stem := strings.TrimSuffix(filepath.Base(path), ".rootfs")
+	if i := strings.LastIndex(stem, "-"); i >= 0 {
+		stem = stem[:i]
+	}
+
+	return stem
+}
+
+func metricsRequestHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		h.ServeHTTP(recorder, r)
+
+		handler := handlerName(r.URL.Path)
+		metrics.observeRequest(handler, recorder.status, time.Since(started))
+
+		// only existing files, so clients can't create arbitrary products
+		if handler == "rootfs" && (recorder.status == http.StatusOK || recorder.status == http.StatusPartialContent) {
+			metrics.addServedBytes(rootfsProduct(r.URL.Path), recorder.bytes)
+		}
+	})
+}
+
+// escapeLabel escapes a label value for the text exposition format
+func escapeLabel(s string) string {
+	s = strings.ReplaceAll(s, "\\", "\\\\")
+	s = strings.ReplaceAll(s, "\"", "\\\"")
+	s = strings.ReplaceAll(s, "\n", "\\n")
+
+	return s
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func writeHeader(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// productAges returns the age of the current version of every product with
+// readable metadata and the number of products whose metadata can't be read
+func productAges(now time.Time) (map[string]float64, int, error) {
+	lock, err := lockMetadata()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to lock metadata: %w", err)
+	}
+	defer lock.Unlock()
+
+	files, err := ioutil.ReadDir(imagesDir)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open images dir `%s`: %w", imagesDir, err)
+	}
+
+	ages := map[string]float64{}
+	unreadable := 0
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".meta" {
+			continue
+		}
+
+		productName := strings.TrimSuffix(file.Name(), ".meta")
+		metadataPath := filepath.Join(imagesDir, file.Name())
+
+		metadata, err := common.ReadRootfsMetaData(metadataPath)
+		if err != nil {
+			log.Errorf("failed to read rootfs data from `%s`: %v", file.Name(), err)
+			unreadable++
+			continue
+		}
+
+		// metadata of older lxdocker versions doesn't contain a date
+		created := metadata.Created
+		if created.IsZero() {
+			if info, err := os.Stat(metadataPath); err == nil {
+				created = info.ModTime()
+			}
+		}
+
+		ages[productName] = now.Sub(created).Seconds()
+	}
+
+	return ages, unreadable, nil
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	ages, unreadable, err := productAges(time.Now())
+	if err != nil {
+		internalError(w, "failed to read metadata", ": %v", err)
+		return
+	}
+
+	var out bytes.Buffer
+
+	writeHeader(&out, "imgserver_products", "gauge", "Number of products with readable metadata.")
+	fmt.Fprintf(&out, "imgserver_products %d\n", len(ages))
+
+	writeHeader(&out, "imgserver_unreadable_products", "gauge", "Number of products whose metadata can't be read.")
+	fmt.Fprintf(&out, "imgserver_unreadable_products %d\n", unreadable)
+
+	writeHeader(&out, "imgserver_product_age_seconds", "gauge", "Age of the current version of a product.")
+	for _, product := range sortedKeys(ages) {
+		fmt.Fprintf(&out, "imgserver_product_age_seconds{product=\"%s\"} %s\n", escapeLabel(product), formatFloat(ages[product]))
+	}
+
+	metrics.mutex.Lock()
+
+	writeHeader(&out, "imgserver_http_requests_total", "counter", "HTTP requests per handler and status code.")
+	keys := make([]requestKey, 0, len(metrics.requests))
+	for key := range metrics.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].handler != keys[j].handler {
+			return keys[i].handler < keys[j].handler
+		}
+		return keys[i].code < keys[j].code
+	})
+	for _, key := range keys {
+		fmt.Fprintf(&out, "imgserver_http_requests_total{handler=\"%s\",code=\"%d\"} %d\n", key.handler, key.code, metrics.requests[key])
+	}
+
+	writeHeader(&out, "imgserver_http_request_duration_seconds", "histogram", "Duration of HTTP requests per handler.")
+	for _, handler := range sortedKeys(metrics.durations) {
+		h := metrics.durations[handler]
+
+		cumulative := uint64(0)
+		for i, bound := range durationBuckets {
+			cumulative += h.buckets[i]
+			fmt.Fprintf(&out, "imgserver_http_request_duration_seconds_bucket{handler=\"%s\",le=\"%s\"} %d\n", handler, formatFloat(bound), cumulative)
+		}
+		fmt.Fprintf(&out, "imgserver_http_request_duration_seconds_bucket{handler=\"%s\",le=\"+Inf\"} %d\n", handler, h.count)
+		fmt.Fprintf(&out, "imgserver_http_request_duration_seconds_sum{handler=\"%s\"} %s\n", handler, formatFloat(h.sum))
+		fmt.Fprintf(&out, "imgserver_http_request_duration_seconds_count{handler=\"%s\"} %d\n", handler, h.count)
+	}
+
+	writeHeader(&out, "imgserver_served_bytes_total", "counter", "Bytes of rootfs' served per product.")
+	for _, product := range sortedKeys(metrics.servedBytes) {
+		fmt.Fprintf(&out, "imgserver_served_bytes_total{product=\"%s\"} %d\n", escapeLabel(product), metrics.servedBytes[product])
+	}
+
+	metrics.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(out.Bytes())
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"gopkg.in/yaml.v3"
+)
+
+type RegistryCredential struct {
+	Registry string
+	Username string
+	// password or access token
+	Password string
+}
+
+var registryCredentials = map[string]RegistryCredential{}
+
+func readRegistryCredentials(path string) (map[string]RegistryCredential, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read `%s`: %w", path, err)
+	}
+
+	credentials := map[string]RegistryCredential{}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	err = decoder.Decode(&credentials)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse `%s`: %w", path, err)
+	}
+
+	for credentialName, credential := range credentials {
+		// normalize the registry so `docker.io` matches `index.docker.io`
+		registry, err := name.NewRegistry(credential.Registry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid registry for credential `%s`: %w", credentialName, err)
+		}
+
+		credential.Registry = registry.RegistryStr()
+		credentials[credentialName] = credential
+	}
+
+	return credentials, nil
+}
+
+// credentialKeychain resolves registries using the credentials from
+// `--registry-auth`. If there's more than one for the same registry, the first
+// one by name wins.
+type credentialKeychain struct{}
+
+func (credentialKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	names := []string{}
+	for credentialName := range registryCredentials {
+		names = append(names, credentialName)
+	}
+	sort.Strings(names)
+
+	for _, credentialName := range names {
+		credential := registryCredentials[credentialName]
+		if credential.Registry != target.RegistryStr() {
+			continue
+		}
+
+		return credential.authenticator(), nil
+	}
+
+	return authn.Anonymous, nil
+}
+
+func (credential RegistryCredential) authenticator() authn.Authenticator {
+	return authn.FromConfig(authn.AuthConfig{
+		Username: credential.Username,
+		Password: credential.Password,
+	})
+}
+
+// getAuthenticator returns the authenticator to use for `ref`.
+// Named credentials from the spec take precedence over the ones from
+// `--registry-auth`, which take precedence over docker's config.json and its
+// credential helpers.
+func getAuthenticator(ref name.Reference, spec ImageSpec) (authn.Authenticator, error) {
+	registry := ref.Context().Registry
+
+	if spec.Auth != "" {
+		credential, ok := registryCredentials[spec.Auth]
+		if !ok {
+			return nil, fmt.Errorf("unknown registry credential `%s`", spec.Auth)
+		}
+
+		// don't send secrets to registries they don't belong to
+		if credential.Registry != registry.RegistryStr() {
+			return nil, fmt.Errorf("registry credential `%s` is for `%s`, not `%s`", spec.Auth, credential.Registry, registry.RegistryStr())
+		}
+
+		return credential.authenticator(), nil
+	}
+
+	keychain := authn.NewMultiKeychain(credentialKeychain{}, authn.DefaultKeychain)
+
+	auth, err := keychain.Resolve(registry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve credentials for `%s`: %w", registry.RegistryStr(), err)
+	}
+
+	return auth, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"pkg/common"
+)
+
+const hostBusybox = "/bin/busybox"
+
+var busyboxDir string
+
+type elfTarget struct {
+	machine elf.Machine
+	class   elf.Class
+	order   binary.ByteOrder
+}
+
+var elfTargets = map[string]elfTarget{
+	"x86_64":  {elf.EM_X86_64, elf.ELFCLASS64, binary.LittleEndian},
+	"i686":    {elf.EM_386, elf.ELFCLASS32, binary.LittleEndian},
+	"aarch64": {elf.EM_AARCH64, elf.ELFCLASS64, binary.LittleEndian},
+	"armv7l":  {elf.EM_ARM, elf.ELFCLASS32, binary.LittleEndian},
+	"ppc64le": {elf.EM_PPC64, elf.ELFCLASS64, binary.LittleEndian},
+	"ppc64":   {elf.EM_PPC64, elf.ELFCLASS64, binary.BigEndian},
+	"s390x":   {elf.EM_S390, elf.ELFCLASS64, binary.BigEndian},
+	"riscv64": {elf.EM_RISCV, elf.ELFCLASS64, binary.LittleEndian},
+	"mips64":  {elf.EM_MIPS, elf.ELFCLASS64, binary.LittleEndian},
+	"mips":    {elf.EM_MIPS, elf.ELFCLASS32, binary.LittleEndian},
+}
+
+// checkStaticElf makes sure `path` runs inside of containers of
+// `architecture` which don't have a dynamic linker or libc
+func checkStaticElf(path string, architecture string) error {
+	target, ok := elfTargets[architecture]
+	if !ok {
+		return fmt.Errorf("unsupported architecture `%s`", architecture)
+	}
+
+	file, err := elf.Open(path)
+	if err != nil {
+		return fmt.Errorf("`%s` is not an ELF binary: %w", path, err)
+	}
+	defer file.Close()
+
+	if file.Machine != target.machine || file.Class != target.class || file.ByteOrder != target.order {
+		return fmt.Errorf("`%s` is a %v %v %v binary, not %s", path, file.Machine, file.Class, file.ByteOrder, architecture)
+	}
+
+	for _, prog := range file.Progs {
+		if prog.Type == elf.PT_INTERP {
+			return fmt.Errorf("`%s` is dynamically linked", path)
+		}
+	}
+
+	libraries, err := file.ImportedLibraries()
+	if err != nil {
+		return fmt.Errorf("failed to read dynamic section of `%s`: %w", path, err)
+	}
+	if len(libraries) > 0 {
+		return fmt.Errorf("`%s` depends on shared libraries: %v", path, libraries)
+	}
+
+	return nil
+}
+
+// getBusybox returns the path to a static busybox for `platform`. Binaries in
+// `--busybox` are named `busybox-ARCH` using LXD's architecture names. The
+// one of the host is only used as a fallback for its own platform.
+func getBusybox(platform v1.Platform) (string, error) {
+	architecture, err := common.LxdArchitecture(platform)
+	if err != nil {
+		return "", err
+	}
+
+	path := ""
+	if busyboxDir != "" {
+		candidate := filepath.Join(busyboxDir, fmt.Sprintf("busybox-%s", architecture))
+		if _, err := os.Stat(candidate); err == nil {
+			path = candidate
+		}
+	}
+
+	host := currentPlatform()
+	if path == "" && platform.OS == host.OS && platform.Architecture == host.Architecture {
+		path = hostBusybox
+	}
+
+	if path == "" {
+		return "", fmt.Errorf("no busybox available for platform `%s`, add `busybox-%s` to `--busybox`", platform.String(), architecture)
+	}
+
+	err = checkStaticElf(path, architecture)
+	if err != nil {
+		return "", fmt.Errorf("unusable busybox for platform `%s`: %w", platform.String(), err)
+	}
+
+	return path, nil
+}
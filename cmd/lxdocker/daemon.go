@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/spf13/cobra"
+)
+
+type specSchedule struct {
+	next     time.Time
+	failures int
+	specHash v1.Hash
+}
+
+type daemon struct {
+	ociDir   string
+	specDir  string
+	imageDir string
+
+	interval   time.Duration
+	jitter     float64
+	retryDelay time.Duration
+
+	schedules map[string]*specSchedule
+
+	mutex sync.Mutex
+	// specs that should be rebuilt in the next run, "" means all of them
+	rebuilds map[string]bool
+	wake     chan struct{}
+}
+
+func (d *daemon) trigger(name string) {
+	d.mutex.Lock()
+	d.rebuilds[name] = true
+	d.mutex.Unlock()
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (d *daemon) takeRebuilds() map[string]bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	rebuilds := d.rebuilds
+	d.rebuilds = map[string]bool{}
+
+	return rebuilds
+}
+
+// withJitter spreads the updates so they don't all hit the registry at once
+func (d *daemon) withJitter(duration time.Duration) time.Duration {
+	factor := 1 + d.jitter*(2*rand.Float64()-1)
+	return time.Duration(float64(duration) * factor)
+}
+
+func (d *daemon) backoff(failures int, refresh time.Duration) time.Duration {
+	delay := d.retryDelay
+	for i := 1; i < failures && delay < refresh; i++ {
+		delay *= 2
+	}
+
+	if delay > refresh {
+		delay = refresh
+	}
+
+	return d.withJitter(delay)
+}
+
+func (d *daemon) run() {
+	now := time.Now()
+	rebuilds := d.takeRebuilds()
+
+	specHashes := map[string]v1.Hash{}
+	refreshes := map[string]time.Duration{}
+
+	// jobs call the filter concurrently
+	var filterMutex sync.Mutex
+	filter := func(name string, spec ImageSpec, specHash v1.Hash) updateMode {
+		filterMutex.Lock()
+		defer filterMutex.Unlock()
+
+		specHashes[name] = specHash
+		refreshes[name] = d.interval
+		if spec.Refresh > 0 {
+			refreshes[name] = spec.Refresh
+		}
+
+		if rebuilds[""] || rebuilds[name] {
+			return updateForce
+		}
+
+		schedule, ok := d.schedules[name]
+		if !ok || schedule.specHash != specHash || !now.Before(schedule.next) {
+			return updateCheck
+		}
+
+		return updateSkip
+	}
+
+	reports, err := updateAndCollect(d.ociDir, d.specDir, d.imageDir, filter)
+	if err != nil {
+		log.Errorf("update failed: %v", err)
+
+		// there are reports if only the garbage collection failed
+		if reports == nil {
+			return
+		}
+	}
+
+	results := map[string]bool{}
+	for _, report := range reports {
+		if report.Status != reportSkipped {
+			results[report.Name] = report.Status != reportFailed
+		}
+	}
+
+	// forget about deleted specs
+	for name := range d.schedules {
+		if _, ok := specHashes[name]; !ok {
+			if _, ok := results[name]; !ok {
+				delete(d.schedules, name)
+			}
+		}
+	}
+
+	for name, succeeded := range results {
+		schedule, ok := d.schedules[name]
+		if !ok {
+			schedule = &specSchedule{}
+			d.schedules[name] = schedule
+		}
+
+		refresh, ok := refreshes[name]
+		if !ok {
+			refresh = d.interval
+		}
+
+		schedule.specHash = specHashes[name]
+		if !succeeded {
+			schedule.failures++
+			schedule.next = now.Add(d.backoff(schedule.failures, refresh))
+
+			log.Infof("retry `%v` at %v after %d failures", name, schedule.next.Format(time.RFC3339), schedule.failures)
+		} else {
+			schedule.failures = 0
+			schedule.next = now.Add(d.withJitter(refresh))
+		}
+	}
+}
+
+// nextRun returns when the next spec is due. New specs are picked up after
+// one interval at the latest.
+func (d *daemon) nextRun() time.Time {
+	next := time.Now().Add(d.interval)
+
+	for _, schedule := range d.schedules {
+		if schedule.next.Before(next) {
+			next = schedule.next
+		}
+	}
+
+	return next
+}
+
+// hasSpec returns whether there's a spec called `name`
+func (d *daemon) hasSpec(name string) (bool, error) {
+	specPaths, err := listSpecs(d.specDir)
+	if err != nil {
+		return false, err
+	}
+
+	for _, specPath := range specPaths {
+		if specName(specPath) == name {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// handleControl serves a single connection to the control socket.
+// Supported commands are `rebuild` and `rebuild NAME`.
+func (d *daemon) handleControl(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+
+		switch {
+		case len(fields) == 1 && fields[0] == "rebuild":
+			log.Infof("rebuild of all images requested")
+			d.trigger("")
+		case len(fields) == 2 && fields[0] == "rebuild":
+			known, err := d.hasSpec(fields[1])
+			if err != nil {
+				log.Errorf("failed to look up `%v`: %v", fields[1], err)
+				fmt.Fprintf(conn, "error: %v\n", err)
+				continue
+			}
+			if !known {
+				fmt.Fprintf(conn, "error: unknown image\n")
+				continue
+			}
+
+			log.Infof("rebuild of `%v` requested", fields[1])
+			d.trigger(fields[1])
+		default:
+			fmt.Fprintf(conn, "error: unknown command\n")
+			continue
+		}
+
+		fmt.Fprintf(conn, "ok\n")
+	}
+}
+
+func (d *daemon) listenControl(path string) error {
+	// remove the socket of a previous instance
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove old control socket: %w", err)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("failed to listen on control socket: %w", err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				log.Errorf("failed to accept control connection: %v", err)
+				return
+			}
+
+			go d.handleControl(conn)
+		}
+	}()
+
+	return nil
+}
+
+func newDaemonCommand(ociDir *string, specDir *string, imageDir *string) *cobra.Command {
+	var controlSocket string
+
+	d := &daemon{
+		schedules: map[string]*specSchedule{},
+		rebuilds:  map[string]bool{},
+		wake:      make(chan struct{}, 1),
+	}
+
+	var daemonCmd = &cobra.Command{
+		Use:   "daemon",
+		Short: "keep the LXD images up to date",
+		Run: func(cmd *cobra.Command, args []string) {
+			d.ociDir = *ociDir
+			d.specDir = *specDir
+			d.imageDir = *imageDir
+
+			if controlSocket != "" {
+				err := d.listenControl(controlSocket)
+				if err != nil {
+					log.Fatalf("%v", err)
+					return
+				}
+			}
+
+			ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+			defer stop()
+
+			for {
+				d.run()
+
+				next := d.nextRun()
+				log.Infof("next update at %v", next.Format(time.RFC3339))
+
+				timer := time.NewTimer(time.Until(next))
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					log.Infof("Done")
+					return
+				case <-d.wake:
+					timer.Stop()
+				case <-timer.C:
+				}
+			}
+		},
+	}
+
+	daemonCmd.Flags().DurationVar(&d.interval, "interval", time.Hour, "how often to check for updates")
+	daemonCmd.Flags().Float64Var(&d.jitter, "jitter", 0.1, "randomize intervals by up to this fraction")
+	daemonCmd.Flags().DurationVar(&d.retryDelay, "retry-delay", time.Minute, "delay before retrying a failed spec, doubled after every failure")
+	daemonCmd.Flags().StringVar(&controlSocket, "control-socket", "", "path to unix socket for triggering rebuilds")
+
+	return daemonCmd
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// envFileParser is an awk program which turns env files into `export` commands
+// the init script can eval. Lines have to be `KEY=value`, where the value may
+// be quoted like in docker compose's .env files:
+//   - unquoted values are used as-is, except for trailing whitespace and
+//     comments starting with ` #`
+//   - single-quoted values are used as-is
+//   - double-quoted values support the escapes `\n`, `\t`, `\\`, `\"` and `\$`
+//
+// Empty lines and comments are ignored, everything else is logged and skipped.
+// It doesn't contain single quotes so it can be put into a shell script as is.
+const envFileParser = `
+function fail(msg) {
+	printf "lxdocker: %s:%d: %s\n", FILENAME, FNR, msg > "/dev/stderr"
+}
+function quote(s) {
+	gsub(/\047/, "\047\\\\\047\047", s)
+	return "\047" s "\047"
+}
+/^[ \t]*(#|$)/ { next }
+{
+	line = $0
+	sub(/\r$/, "", line)
+	if (!match(line, /^[A-Za-z_][A-Za-z0-9_]*=/)) {
+		fail("expected KEY=value")
+		next
+	}
+	key = substr(line, 1, RLENGTH - 1)
+	value = substr(line, RLENGTH + 1)
+	rest = ""
+
+	c = substr(value, 1, 1)
+	if (c == "\047") {
+		end = index(substr(value, 2), "\047")
+		if (end == 0) {
+			fail("unterminated quote")
+			next
+		}
+		rest = substr(value, end + 2)
+		value = substr(value, 2, end - 1)
+	} else if (c == "\"") {
+		out = ""
+		closed = 0
+		for (i = 2; i <= length(value); i++) {
+			ch = substr(value, i, 1)
+			if (ch == "\"") {
+				closed = 1
+				break
+			}
+			if (ch == "\\") {
+				i++
+				ch = substr(value, i, 1)
+				if (ch == "n") {
+					ch = "\n"
+				} else if (ch == "t") {
+					ch = "\t"
+				} else if (ch != "\\" && ch != "\"" && ch != "$") {
+					ch = "\\" ch
+				}
+			}
+			out = out ch
+		}
+		if (!closed) {
+			fail("unterminated quote")
+			next
+		}
+		rest = substr(value, i + 1)
+		value = out
+	} else {
+		sub(/[ \t]+#.*$/, "", value)
+		sub(/[ \t]+$/, "", value)
+	}
+
+	if (rest !~ /^[ \t]*(#.*)?$/) {
+		fail("unexpected characters after the closing quote")
+		next
+	}
+
+	print "export " key "=" quote(value)
+}
+`
+
+// writeInitEnvFiles writes the part of the init script which loads the env
+// files in `LXDOCKER_ENVFILE`. That's a colon-separated list of files and
+// directories, from which all `*.env` files are loaded in alphabetical order.
+// The files are parsed, so they can't execute any code.
+func writeInitEnvFiles(data *bytes.Buffer) {
+	_, err := fmt.Fprintf(data, "if [ -n \"$LXDOCKER_ENVFILE\" ]; then\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\tlxdocker_env=\"$(\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\t\tIFS=:\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\t\tfor lxdocker_path in $LXDOCKER_ENVFILE; do\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\t\t\tif [ -d \"$lxdocker_path\" ]; then\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\t\t\t\tset -- \"$lxdocker_path\"/*.env\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\t\t\telif [ -f \"$lxdocker_path\" ]; then\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\t\t\t\tset -- \"$lxdocker_path\"\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\t\t\telse\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\t\t\t\techo \"lxdocker: can't find env file $lxdocker_path\" >&2; set --\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\t\t\tfi\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\t\t\tfor lxdocker_file in \"$@\"; do\n")
+	check(err)
+	// globs without a match stay as they are
+	_, err = fmt.Fprintf(data, "\t\t\t\t[ -f \"$lxdocker_file\" ] || continue\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\t\t\t\t/busybox-lxd awk '%s' \"$lxdocker_file\"\n", envFileParser)
+	check(err)
+	_, err = fmt.Fprintf(data, "\t\t\tdone\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\t\tdone\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\t)\"\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\teval \"$lxdocker_env\"\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "fi\n")
+	check(err)
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"pkg/common"
+)
+
+// SpecFile is a file or directory which gets added to the rootfs
+type SpecFile struct {
+	// path relative to the spec dir, can be a directory or a symlink to one
+	Source string
+	// used instead of `source`
+	Content *string
+	Dest    string
+	// octal, defaults to 0644. Files from a source directory keep their mode.
+	Mode     string
+	UID      int `yaml:"uid"`
+	GID      int `yaml:"gid"`
+	Template bool
+}
+
+// fileTemplateData is what templates of spec files can use
+type fileTemplateData struct {
+	Name         string
+	Image        string
+	Platform     string
+	Architecture string
+	Env          map[string]string
+}
+
+// sourcePath returns the path of `source`. If it's a symlink, that's the path
+// of its target, so the target gets copied instead of the link.
+func (file SpecFile) sourcePath(specDir string) (string, error) {
+	return filepath.EvalSymlinks(filepath.Join(specDir, file.Source))
+}
+
+func (file SpecFile) mode() (int64, error) {
+	if file.Mode == "" {
+		return 0644, nil
+	}
+
+	mode, err := strconv.ParseUint(file.Mode, 8, 32)
+	if err != nil || mode > 07777 {
+		return 0, fmt.Errorf("invalid mode `%s` of `%s`", file.Mode, file.Dest)
+	}
+
+	return int64(mode), nil
+}
+
+func (file SpecFile) validate() error {
+	if (file.Source == "") == (file.Content == nil) {
+		return fmt.Errorf("`%s` needs either a source or content", file.Dest)
+	}
+
+	// sources have to be part of the spec dir, so specs can be shared
+	if file.Source != "" {
+		source := filepath.Clean(file.Source)
+		if filepath.IsAbs(source) || source == ".." || strings.HasPrefix(source, "../") {
+			return fmt.Errorf("source `%s` isn't relative to the spec directory", file.Source)
+		}
+	}
+
+	if !filepath.IsAbs(file.Dest) {
+		return fmt.Errorf("destination `%s` isn't an absolute path", file.Dest)
+	}
+
+	_, err := file.mode()
+	return err
+}
+
+// hashSpecFiles returns the digest of the spec, which includes the contents
+// of all files it references so changing them triggers a rebuild
+func hashSpecFiles(specBytes []byte, spec ImageSpec) (v1.Hash, error) {
+	if len(spec.Files) == 0 {
+		return hashToV1Sized(sha256.Sum256(specBytes)), nil
+	}
+
+	hash := sha256.New()
+	hash.Write(specBytes)
+
+	for _, file := range spec.Files {
+		if file.Source == "" {
+			continue
+		}
+
+		source, err := file.sourcePath(spec.dir)
+		if err != nil {
+			return v1.Hash{}, fmt.Errorf("failed to hash `%s`: %w", file.Source, err)
+		}
+
+		err = filepath.WalkDir(source, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+
+			relpath, err := filepath.Rel(source, path)
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(hash, "\x00%s\x00%s\x00%o\x00", file.Source, relpath, info.Mode())
+
+			switch {
+			case info.Mode().IsRegular():
+				input, err := os.Open(path)
+				if err != nil {
+					return err
+				}
+				defer input.Close()
+
+				if _, err := io.Copy(hash, input); err != nil {
+					return err
+				}
+			case info.Mode()&fs.ModeSymlink != 0:
+				target, err := os.Readlink(path)
+				if err != nil {
+					return err
+				}
+
+				fmt.Fprintf(hash, "%s", target)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return v1.Hash{}, fmt.Errorf("failed to hash `%s`: %w", file.Source, err)
+		}
+	}
+
+	return hashToV1(hash.Sum(nil)), nil
+}
+
+func newFileTemplateData(name string, spec ImageSpec, configFile *v1.ConfigFile, config *v1.Config) (*fileTemplateData, error) {
+	architecture, err := common.LxdArchitecture(imagePlatform(configFile))
+	if err != nil {
+		return nil, err
+	}
+
+	data := &fileTemplateData{
+		Name:         name,
+		Image:        spec.Image,
+		Platform:     imagePlatform(configFile).String(),
+		Architecture: architecture,
+		Env:          map[string]string{},
+	}
+
+	for _, keyval := range config.Env {
+		key, value, _ := strings.Cut(keyval, "=")
+		data.Env[key] = value
+	}
+
+	return data, nil
+}
+
+func writeSpecFile(tarWriter archiveWriter, fileMap map[string]bool, header *tar.Header, contents []byte) error {
+	header.Name = strings.TrimPrefix(filepath.Clean(header.Name), "/")
+
+	// writeTarFile would silently skip it
+	if _, ok := fileMap[header.Name]; ok {
+		if header.Typeflag == tar.TypeDir {
+			return nil
+		}
+
+		return fmt.Errorf("`/%s` is generated by lxdocker or another file of the spec", header.Name)
+	}
+
+	header.Size = int64(len(contents))
+
+	return writeTarFile(tarWriter, fileMap, header, bytes.NewReader(contents))
+}
+
+// writeSpecFiles adds the `files` of the spec to the rootfs. They replace the
+// files from the OCI image, source directories are merged with the directories
+// of the image.
+func writeSpecFiles(tarWriter archiveWriter, fileMap map[string]bool, name string, spec ImageSpec, configFile *v1.ConfigFile, config *v1.Config) error {
+	templateData, err := newFileTemplateData(name, spec, configFile, config)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range spec.Files {
+		mode, err := file.mode()
+		if err != nil {
+			return err
+		}
+
+		if file.Content != nil {
+			contents := []byte(*file.Content)
+			if file.Template {
+				contents, err = renderTemplate(file.Dest, contents, templateData)
+				if err != nil {
+					return err
+				}
+			}
+
+			header := &tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     file.Dest,
+				Mode:     mode,
+				Uid:      file.UID,
+				Gid:      file.GID,
+			}
+
+			err = writeSpecFile(tarWriter, fileMap, header, contents)
+			if err != nil {
+				return fmt.Errorf("failed to write `%s`: %w", file.Dest, err)
+			}
+
+			continue
+		}
+
+		source, err := file.sourcePath(spec.dir)
+		if err != nil {
+			return fmt.Errorf("failed to write `%s`: %w", file.Dest, err)
+		}
+
+		if file.Template {
+			info, err := os.Stat(source)
+			if err != nil {
+				return fmt.Errorf("failed to write `%s`: %w", file.Dest, err)
+			}
+			if info.IsDir() {
+				return fmt.Errorf("source `%s` of `%s` is a directory, which can't be a template", file.Source, file.Dest)
+			}
+		}
+
+		err = filepath.WalkDir(source, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+
+			relpath, err := filepath.Rel(source, path)
+			if err != nil {
+				return err
+			}
+
+			header := &tar.Header{
+				Name: filepath.Join(file.Dest, relpath),
+				Mode: int64(info.Mode().Perm()),
+				Uid:  file.UID,
+				Gid:  file.GID,
+			}
+			contents := []byte{}
+
+			switch {
+			case info.IsDir():
+				// keep the attributes of existing directories
+				if path == source {
+					return nil
+				}
+
+				header.Typeflag = tar.TypeDir
+			case info.Mode().IsRegular():
+				header.Typeflag = tar.TypeReg
+				contents, err = os.ReadFile(path)
+				if err != nil {
+					return err
+				}
+
+				if path == source {
+					header.Mode = mode
+					if file.Template {
+						contents, err = renderTemplate(file.Dest, contents, templateData)
+						if err != nil {
+							return err
+						}
+					}
+				}
+			case info.Mode()&fs.ModeSymlink != 0:
+				header.Typeflag = tar.TypeSymlink
+				header.Linkname, err = os.Readlink(path)
+				if err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("unsupported file type of `%s`", path)
+			}
+
+			return writeSpecFile(tarWriter, fileMap, header, contents)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to write `%s`: %w", file.Dest, err)
+		}
+	}
+
+	return nil
+}
+
+func renderTemplate(name string, text []byte, data *fileTemplateData) ([]byte, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(string(text))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse template: %w", err)
+	}
+
+	var result bytes.Buffer
+	err = tmpl.Execute(&result, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render template: %w", err)
+	}
+
+	return result.Bytes(), nil
+}
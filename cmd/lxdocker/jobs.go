@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"pkg/common"
+)
+
+// number of specs which get updated at the same time
+var jobs int
+
+// bounds network fetches and CPU-bound work like running build steps and
+// compressing the rootfs across all jobs. nil means unbounded.
+var fetchSlots slots
+var buildSlots slots
+
+// layoutMutex serializes access to the index of the OCI layout. Blobs are
+// written outside of it, see fetchImageBlobs.
+var layoutMutex sync.Mutex
+
+// slots is a semaphore
+type slots chan struct{}
+
+func newSlots(n int) slots {
+	if n <= 0 {
+		return nil
+	}
+
+	return make(slots, n)
+}
+
+func (s slots) acquire() {
+	if s != nil {
+		s <- struct{}{}
+	}
+}
+
+func (s slots) release() {
+	if s != nil {
+		<-s
+	}
+}
+
+// specJob is the update of a single spec. Everything it produces is merged
+// in spec order once it's done, so the result doesn't depend on scheduling.
+type specJob struct {
+	name     string
+	specPath string
+
+	usedLxdMetadata map[string]bool
+	usedOciImages   map[v1.Hash]bool
+	usedLxdImages   map[string]bool
+
+	// logs of the job if it runs in parallel to others
+	logs   bytes.Buffer
+	report specReport
+	done   chan struct{}
+}
+
+func newSpecJob(specPath string) *specJob {
+	return &specJob{
+		name:            specName(specPath),
+		specPath:        specPath,
+		usedLxdMetadata: map[string]bool{},
+		usedOciImages:   map[v1.Hash]bool{},
+		usedLxdImages:   map[string]bool{},
+		report:          specReport{Name: specName(specPath)},
+		done:            make(chan struct{}),
+	}
+}
+
+func (job *specJob) run(ociDir string, imageDir string, filter updateFilter, buffered bool) {
+	defer close(job.done)
+
+	logger := log
+	var output io.Writer = os.Stderr
+	if buffered {
+		logger = common.MakeWriterLogger(&job.logs)
+		output = &job.logs
+	}
+	defer logger.Sync()
+
+	started := time.Now()
+	skipped, err := updateSpec(logger, output, ociDir, job.specPath, imageDir, job.name, filter, &job.report, job.usedLxdMetadata, job.usedOciImages, job.usedLxdImages)
+	if !skipped && err != nil {
+		logger.Errorf("failed to update `%v`: %v", job.name, err)
+	}
+
+	job.report.finish(skipped, err, time.Since(started))
+}
+
+// runSpecJobs updates all specs with up to `jobs` workers. The logs of a spec
+// get written as a whole once it's done and all previous specs are done, so
+// they don't interleave.
+func runSpecJobs(ociDir string, specPaths []string, imageDir string, filter updateFilter) []*specJob {
+	specJobs := make([]*specJob, len(specPaths))
+	for i, specPath := range specPaths {
+		specJobs[i] = newSpecJob(specPath)
+	}
+
+	workers := jobs
+	if workers > len(specJobs) {
+		workers = len(specJobs)
+	}
+	buffered := workers > 1
+
+	queue := make(chan *specJob)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range queue {
+				job.run(ociDir, imageDir, filter, buffered)
+			}
+		}()
+	}
+
+	go func() {
+		for _, job := range specJobs {
+			queue <- job
+		}
+		close(queue)
+	}()
+
+	for _, job := range specJobs {
+		<-job.done
+
+		if buffered {
+			os.Stderr.Write(job.logs.Bytes())
+			job.logs.Reset()
+		}
+	}
+
+	return specJobs
+}
@@ -10,11 +10,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"pkg/common"
+	"regexp"
 	"runtime"
 	"strings"
 	"time"
@@ -34,9 +35,26 @@ import (
 )
 
 const whiteoutPrefix = ".wh."
+const opaqueWhiteout = ".wh..wh..opq"
+
+// annotation with the digest the reference resolved to when we fetched the
+// image. For multi-platform images, that's the digest of the index.
+const annotationRemoteDigest = "com.github.m1cha.lxdocker.remote.digest"
+
+// annotation with the reference we fetched the image with, which contains the
+// pinned digest of the spec
+const annotationFetchRef = "com.github.m1cha.lxdocker.fetch.ref"
+
+// prefix of the temporary layouts images get fetched to
+const fetchTmpPrefix = "fetch-tmp-"
 
 var log *zap.SugaredLogger
 var imageFormat string
+var squashfsCompression string
+var keepVersions int
+var maxAge time.Duration
+var waitForLock bool
+var offline bool
 
 //go:embed udhcpc.script
 var udhcpc_script_data []byte
@@ -49,12 +67,25 @@ func shellEscape(s string) string {
 	return s
 }
 
+// shellQuote quotes `s` with single quotes, so the shell doesn't expand
+// anything in it
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "'\\''") + "'"
+}
+
 func check(err error) {
 	if err != nil {
 		panic(err)
 	}
 }
 
+// archiveWriter is implemented by tar.Writer and SquashfsWriter, so the rootfs
+// can be written to both of them.
+type archiveWriter interface {
+	WriteHeader(header *tar.Header) error
+	io.Writer
+}
+
 func inWhiteoutDir(fileMap map[string]bool, file string) bool {
 	for {
 		if file == "" {
@@ -67,12 +98,51 @@ func inWhiteoutDir(fileMap map[string]bool, file string) bool {
 		if val, ok := fileMap[dirname]; ok && val {
 			return true
 		}
+		if fileMap[opaqueKey(dirname)] {
+			return true
+		}
 		file = dirname
 	}
 	return false
 }
 
-func writeTarFile(tarWriter *tar.Writer, fileMap map[string]bool, header *tar.Header, contents io.Reader) error {
+// opaqueKey is the key in the file map which hides the children of an opaque
+// directory, but not the directory itself
+func opaqueKey(dir string) string {
+	return filepath.Join(dir, opaqueWhiteout)
+}
+
+func markOpaqueDir(fileMap map[string]bool, dir string) {
+	// a newer layer already removed or replaced the whole directory
+	if inWhiteoutDir(fileMap, dir) {
+		return
+	}
+
+	// hide all children from older layers. The children of the layer that
+	// contained the opaque marker have been written already. The layer doesn't
+	// need to contain the directory itself, so an older layer may still
+	// provide it.
+	fileMap[opaqueKey(dir)] = true
+}
+
+// markWhiteout hides `name` in older layers
+func markWhiteout(fileMap map[string]bool, name string) {
+	if inWhiteoutDir(fileMap, name) {
+		return
+	}
+
+	hidden, seen := fileMap[name]
+	switch {
+	case !seen:
+		fileMap[name] = true
+	case !hidden:
+		// this or a newer layer has a directory with that name, which
+		// replaces the old one instead of being merged with it
+		fileMap[opaqueKey(name)] = true
+	}
+}
+
+func writeTarFile(tarWriter archiveWriter, fileMap map[string]bool, header *tar.Header, contents io.Reader) error {
 	// Some tools prepend everything with "./", so if we don't Clean the
 	// name, we may have duplicate entries, which angers tar-split.
 	// This removes trailing slashes which would confuse `filepath.Dir` as
@@ -83,51 +153,91 @@ func writeTarFile(tarWriter *tar.Writer, fileMap map[string]bool, header *tar.He
 	// prefers USTAR over PAX
 	header.Format = tar.FormatPAX
 
-	basename := filepath.Base(header.Name)
-	dirname := filepath.Dir(header.Name)
-	tombstone := strings.HasPrefix(basename, whiteoutPrefix)
-	if tombstone {
-		basename = basename[len(whiteoutPrefix):]
-	}
-
-	// use name without (possible) whiteout prefix
-	name := filepath.Join(dirname, basename)
-
 	// check if we have seen value before
-	if _, ok := fileMap[name]; ok {
+	if _, ok := fileMap[header.Name]; ok {
 		return nil
 	}
 
 	// check for a whited out parent directory
-	if inWhiteoutDir(fileMap, name) {
+	if inWhiteoutDir(fileMap, header.Name) {
 		return nil
 	}
 
 	// mark file as handled. non-directory implicitly tombstones
 	// any entries with a matching (or child) name
-	fileMap[name] = tombstone || !(header.Typeflag == tar.TypeDir)
-	if !tombstone {
-		// LXD expects the rootfs in a subdirectory
-		header.Name = filepath.Join("rootfs", header.Name)
-		if header.Typeflag == tar.TypeLink {
-			header.Linkname = filepath.Join("rootfs", header.Linkname)
-		}
+	fileMap[header.Name] = header.Typeflag != tar.TypeDir
 
-		if err := tarWriter.WriteHeader(header); err != nil {
-			return fmt.Errorf("failed to write tar header: %w", err)
-		}
+	// LXD expects the rootfs in a subdirectory
+	header.Name = filepath.Join("rootfs", header.Name)
+	if header.Typeflag == tar.TypeLink {
+		header.Linkname = filepath.Join("rootfs", header.Linkname)
+	}
 
-		if header.Size > 0 {
-			if _, err := io.CopyN(tarWriter, contents, header.Size); err != nil {
-				return fmt.Errorf("failed to write tar contents: %w", err)
-			}
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write tar header: %w", err)
+	}
+
+	if header.Size > 0 {
+		if _, err := io.CopyN(tarWriter, contents, header.Size); err != nil {
+			return fmt.Errorf("failed to write tar contents: %w", err)
 		}
 	}
 
 	return nil
 }
 
-func writeInit(tarWriter *tar.Writer, fileMap map[string]bool, config *v1.Config, spec ImageSpec) error {
+// writeInit helper which defines `lxdocker_exec`, a function that drops
+// privileges to `user` and executes its arguments. Supported formats are
+// `user`, `uid`, `user:group` and `uid:gid`. They get resolved at runtime, so
+// they always match the rootfs' passwd and group files.
+func writeInitUser(data *bytes.Buffer, user string) {
+	if user == "" {
+		_, err := fmt.Fprintf(data, "lxdocker_exec() { exec \"$@\"; }\n")
+		check(err)
+		return
+	}
+
+	// allow LXD's instance config to override the user
+	_, err := fmt.Fprintf(data, "if [ -z \"${LXDOCKER_USER+x}\" ]; then LXDOCKER_USER=\"%s\"; fi\n", shellEscape(user))
+	check(err)
+
+	_, err = fmt.Fprintf(data, "if [ -n \"$LXDOCKER_USER\" ]; then\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\tlxdocker_user=\"${LXDOCKER_USER%%%%:*}\"; lxdocker_group=\"\"\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\tcase \"$LXDOCKER_USER\" in *:*) lxdocker_group=\"${LXDOCKER_USER#*:}\";; esac\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\tlxdocker_passwd=\"$(/busybox-lxd awk -F: -v u=\"$lxdocker_user\" '$1 == u || $3 == u { print; exit }' /etc/passwd 2>/dev/null)\"\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\tif [ -n \"$lxdocker_passwd\" ]; then\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\t\texport HOME=\"$(echo \"$lxdocker_passwd\" | /busybox-lxd cut -d: -f6)\"\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\tfi\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "fi\n")
+	check(err)
+
+	_, err = fmt.Fprintf(data, "lxdocker_exec() {\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\t[ -z \"$LXDOCKER_USER\" ] && exec \"$@\"\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\tlxdocker_exe=\"$1\"; shift\n")
+	check(err)
+	// start-stop-daemon is the only busybox applet that calls initgroups, so
+	// it's the only way to get the supplementary groups right. The pidfile
+	// doesn't exist, it just prevents it from looking for running instances.
+	_, err = fmt.Fprintf(data, "\t[ -n \"$lxdocker_passwd\" ] && exec /busybox-lxd start-stop-daemon -S -p /run/lxdocker-user.pid -c \"$LXDOCKER_USER\" -x \"$lxdocker_exe\" -- \"$@\"\n")
+	check(err)
+	// there's nothing to look up for unknown numeric IDs. Like docker, we
+	// fall back to the root group.
+	_, err = fmt.Fprintf(data, "\texec /busybox-lxd chpst -u \"$lxdocker_user:${lxdocker_group:-0}\" \"$lxdocker_exe\" \"$@\"\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "}\n")
+	check(err)
+}
+
+func writeInit(log *zap.SugaredLogger, tarWriter archiveWriter, fileMap map[string]bool, config *v1.Config, spec ImageSpec) error {
 	var data bytes.Buffer
 
 	_, err := fmt.Fprintf(&data, "#!/busybox-lxd sh\n\n")
@@ -184,34 +294,37 @@ func writeInit(tarWriter *tar.Writer, fileMap map[string]bool, config *v1.Config
 	// allow to load environment variables from a different location
 	// This can be used to load secrets that should not be part of the instance
 	// config.
-	// TODO: load them so the file can't execute any code.
-	_, err = fmt.Fprintf(&data, "[ -n \"$LXDOCKER_ENVFILE\" ] && source \"$LXDOCKER_ENVFILE\"\n")
-	check(err)
-
-	if spec.DisableSupervisor {
-		_, err = fmt.Fprintf(&data, "exec ")
-		check(err)
-	}
+	writeInitEnvFiles(&data)
 
+	_, err = fmt.Fprintf(&data, "set --")
+	check(err)
 	for _, arg := range config.Entrypoint {
-		_, err := fmt.Fprintf(&data, "\"%v\" ", shellEscape(arg))
+		_, err := fmt.Fprintf(&data, " \"%v\"", shellEscape(arg))
 		check(err)
 	}
 	for _, arg := range config.Cmd {
-		_, err := fmt.Fprintf(&data, "\"%v\" ", shellEscape(arg))
+		_, err := fmt.Fprintf(&data, " \"%v\"", shellEscape(arg))
 		check(err)
 	}
+	_, err = fmt.Fprintf(&data, "\n")
+	check(err)
 
-	if !spec.DisableSupervisor {
-		_, err = fmt.Fprintf(&data, "&\n")
-		check(err)
+	user := config.User
+	if spec.User != "" {
+		user = spec.User
+	}
+	writeInitUser(&data, user)
 
-		// send SIGTERM to child if we receive SIGPWR
-		// this makes `lxc stop` work
-		_, err = fmt.Fprintf(&data, "trap 'kill -15 $child' PWR\n")
-		check(err)
-		_, err = fmt.Fprintf(&data, "child=$!; wait \"$child\"\n")
+	if spec.DisableSupervisor {
+		_, err = fmt.Fprintf(&data, "lxdocker_exec \"$@\"\n")
 		check(err)
+	} else {
+		supervisor, err := newSupervisorConfig(log, config, spec)
+		if err != nil {
+			return err
+		}
+
+		writeInitSupervisor(&data, supervisor)
 	}
 
 	header := &tar.Header{
@@ -239,9 +352,22 @@ func writeInit(tarWriter *tar.Writer, fileMap map[string]bool, config *v1.Config
 	return nil
 }
 
-func writeMetadata(tarWriter *tar.Writer, name string, configFile *v1.ConfigFile) error {
-	var metadata = lxdapi.ImageMetadata{
+func imagePlatform(configFile *v1.ConfigFile) v1.Platform {
+	return v1.Platform{
 		Architecture: configFile.Architecture,
+		OS:           configFile.OS,
+		Variant:      configFile.Variant,
+	}
+}
+
+func writeMetadata(tarWriter archiveWriter, name string, configFile *v1.ConfigFile, spec ImageSpec) error {
+	architecture, err := common.LxdArchitecture(imagePlatform(configFile))
+	if err != nil {
+		return err
+	}
+
+	var metadata = lxdapi.ImageMetadata{
+		Architecture: architecture,
 		CreationDate: time.Now().UTC().Unix(),
 		Properties: map[string]string{
 			"description": name,
@@ -273,6 +399,11 @@ func writeMetadata(tarWriter *tar.Writer, name string, configFile *v1.ConfigFile
 		},
 	}
 
+	// tell monitoring where to find the result of the healthcheck
+	if !spec.DisableSupervisor && getHealthcheck(&configFile.Config) != nil {
+		metadata.Properties["user.lxdocker.healthcheck"] = healthFile
+	}
+
 	data, err := yaml.Marshal(&metadata)
 	if err != nil {
 		return fmt.Errorf("failed to marshal metadata: %w", err)
@@ -295,7 +426,7 @@ func writeMetadata(tarWriter *tar.Writer, name string, configFile *v1.ConfigFile
 	return nil
 }
 
-func writeHostFile(tarWriter *tar.Writer, fileMap map[string]bool, dst string, src string, mode int64) error {
+func writeHostFile(tarWriter archiveWriter, fileMap map[string]bool, dst string, src string, mode int64) error {
 	fileinfo, err := os.Stat(src)
 	if err != nil {
 		return fmt.Errorf("can't stat `%s`: %w", src, err)
@@ -321,7 +452,7 @@ func writeHostFile(tarWriter *tar.Writer, fileMap map[string]bool, dst string, s
 	return nil
 }
 
-func writeBytesFile(tarWriter *tar.Writer, fileMap map[string]bool, dst string, src []byte, mode int64) error {
+func writeBytesFile(tarWriter archiveWriter, fileMap map[string]bool, dst string, src []byte, mode int64) error {
 	header := &tar.Header{
 		Name: dst,
 		Mode: mode,
@@ -336,7 +467,7 @@ func writeBytesFile(tarWriter *tar.Writer, fileMap map[string]bool, dst string,
 	return nil
 }
 
-func writeBytesFileGlobal(tarWriter *tar.Writer, dst string, src []byte, mode int64) error {
+func writeBytesFileGlobal(tarWriter archiveWriter, dst string, src []byte, mode int64) error {
 	header := &tar.Header{
 		Name: dst,
 		Mode: mode,
@@ -354,25 +485,34 @@ func writeBytesFileGlobal(tarWriter *tar.Writer, dst string, src []byte, mode in
 	return nil
 }
 
-func generateRootfsTar(img v1.Image, w io.Writer, name string, spec ImageSpec) error {
+func generateRootfsTar(log *zap.SugaredLogger, img v1.Image, w io.Writer, name string, spec ImageSpec) error {
 	tarWriter := tar.NewWriter(w)
 	defer tarWriter.Close()
 
+	return generateRootfs(log, img, tarWriter, name, spec)
+}
+
+func generateRootfs(log *zap.SugaredLogger, img v1.Image, tarWriter archiveWriter, name string, spec ImageSpec) error {
 	fileMap := map[string]bool{}
 
 	configFile, err := img.ConfigFile()
 	if err != nil {
 		return fmt.Errorf("retrieving image config file: %w", err)
 	}
-	config := &configFile.Config
+	config := applySpecConfig(&configFile.Config, spec)
 
 	layers, err := img.Layers()
 	if err != nil {
 		return fmt.Errorf("retrieving image layers: %w", err)
 	}
 
+	busyboxPath, err := getBusybox(imagePlatform(configFile))
+	if err != nil {
+		return err
+	}
+
 	log.Debugf("write busybox")
-	err = writeHostFile(tarWriter, fileMap, "busybox-lxd", "/bin/busybox", 0755)
+	err = writeHostFile(tarWriter, fileMap, "busybox-lxd", busyboxPath, 0755)
 	if err != nil {
 		return fmt.Errorf("failed to write busybox: %w", err)
 	}
@@ -384,9 +524,9 @@ func generateRootfsTar(img v1.Image, w io.Writer, name string, spec ImageSpec) e
 	}
 
 	log.Debugf("write metadata")
-	err = writeMetadata(tarWriter, name, configFile)
+	err = writeMetadata(tarWriter, name, configFile, spec)
 	if err != nil {
-		return fmt.Errorf("failed to write /sbin/init: %w", err)
+		return fmt.Errorf("failed to write metadata: %w", err)
 	}
 
 	log.Debugf("write hostname.tpl")
@@ -408,11 +548,22 @@ func generateRootfsTar(img v1.Image, w io.Writer, name string, spec ImageSpec) e
 	}
 
 	log.Debugf("write init")
-	err = writeInit(tarWriter, fileMap, config, spec)
+	err = writeInit(log, tarWriter, fileMap, config, spec)
 	if err != nil {
 		return fmt.Errorf("failed to write /sbin/init: %w", err)
 	}
 
+	log.Debugf("write spec files")
+	err = writeSpecFiles(tarWriter, fileMap, name, spec, configFile, config)
+	if err != nil {
+		return fmt.Errorf("failed to write spec files: %w", err)
+	}
+
+	return writeLayers(log, tarWriter, fileMap, layers)
+}
+
+// writeLayers merges `layers` into the rootfs, applying their whiteouts
+func writeLayers(log *zap.SugaredLogger, tarWriter archiveWriter, fileMap map[string]bool, layers []v1.Layer) error {
 	// we iterate through the layers in reverse order because it makes handling
 	// whiteout layers more efficient, since we can just keep track of the removed
 	// files as we see .wh. layers and ignore those in previous layers.
@@ -425,6 +576,12 @@ func generateRootfsTar(img v1.Image, w io.Writer, name string, spec ImageSpec) e
 			return fmt.Errorf("reading layer contents: %w", err)
 		}
 		defer layerReader.Close()
+
+		// whiteouts and opaque directories only hide the contents of older
+		// layers, so we can't mark them before we're done with the current one.
+		whiteouts := []string{}
+		opaqueDirs := []string{}
+
 		tarReader := tar.NewReader(layerReader)
 		for {
 			header, err := tarReader.Next()
@@ -435,7 +592,22 @@ func generateRootfsTar(img v1.Image, w io.Writer, name string, spec ImageSpec) e
 				return fmt.Errorf("reading tar: %w", err)
 			}
 
-			if filepath.Clean(header.Name) == "sbin/init" {
+			name := filepath.Clean(header.Name)
+			basename := filepath.Base(name)
+			if basename == opaqueWhiteout {
+				opaqueDirs = append(opaqueDirs, filepath.Dir(name))
+				continue
+			}
+			if strings.HasPrefix(basename, whiteoutPrefix) {
+				name = filepath.Join(filepath.Dir(name), basename[len(whiteoutPrefix):])
+				if name == "sbin/init" {
+					name = "lxd-realinit"
+				}
+				whiteouts = append(whiteouts, name)
+				continue
+			}
+
+			if name == "sbin/init" {
 				header.Name = "lxd-realinit"
 			}
 
@@ -444,233 +616,646 @@ func generateRootfsTar(img v1.Image, w io.Writer, name string, spec ImageSpec) e
 				return fmt.Errorf("writing tar: %w", err)
 			}
 		}
+
+		for _, name := range whiteouts {
+			markWhiteout(fileMap, name)
+		}
+		for _, dir := range opaqueDirs {
+			markOpaqueDir(fileMap, dir)
+		}
 	}
 
 	return nil
 }
 
-func getImageRemote(p layout.Path, ref name.Reference, platform v1.Platform) (v1.Image, error) {
+// cachedFetchRef returns the reference an image in the cache was fetched with.
+// Older versions of lxdocker didn't store it, so use its name instead.
+func cachedFetchRef(desc v1.Descriptor) string {
+	if fetchRef, ok := desc.Annotations[annotationFetchRef]; ok {
+		return fetchRef
+	}
+
+	return desc.Annotations[imagespec.AnnotationRefName]
+}
+
+// getImageRemote fetches `fetchRef` and stores it in the cache as `ref`. It
+// also returns the digest `fetchRef` resolved to in the registry. Specs which
+// pin different digests of the same image don't replace each other's images.
+func getImageRemote(log *zap.SugaredLogger, p layout.Path, ref name.Reference, fetchRef name.Reference, platform v1.Platform, spec ImageSpec) (v1.Image, v1.Hash, error) {
 	// the fetches platform may have addition info, so only compare the parts we care about
 	matcher_platform := func(desc v1.Descriptor) bool {
 		if desc.Platform == nil {
 			return false
 		}
-		if desc.Platform.Architecture == platform.Architecture && desc.Platform.OS == platform.OS {
-			return true
+		if desc.Platform.Architecture != platform.Architecture || desc.Platform.OS != platform.OS {
+			return false
+		}
+		// `arm64` usually comes with variant `v8`, so only compare it if we asked for one
+		if platform.Variant != "" && desc.Platform.Variant != platform.Variant {
+			return false
 		}
 
-		return false
+		return true
 	}
 	matcher := func(desc v1.Descriptor) bool {
-		return match.Name(ref.Name())(desc) && matcher_platform(desc)
+		return match.Name(ref.Name())(desc) && cachedFetchRef(desc) == fetchRef.Name() && matcher_platform(desc)
+	}
+
+	if offline {
+		// pinned digests have to match, everything else uses what we have
+		digest := v1.Hash{}
+		if ref, ok := fetchRef.(name.Digest); ok {
+			digest, _ = v1.NewHash(ref.DigestStr())
+		}
+
+		img, remoteDigest, err := findCachedImage(p, matcher, digest)
+		if err != nil {
+			return nil, v1.Hash{}, err
+		}
+		if img == nil {
+			return nil, v1.Hash{}, fmt.Errorf("`%v` `%v` isn't in the cache", fetchRef.Name(), platform.String())
+		}
+
+		log.Infof("use cached image `%v` `%v`", fetchRef.Name(), platform.String())
+		return img, remoteDigest, nil
+	}
+
+	fetchSlots.acquire()
+	defer fetchSlots.release()
+
+	// a HEAD request is cheaper and doesn't count towards the pull limit of
+	// docker hub
+	var desc *v1.Descriptor
+	err := remoteDo(log, fetchRef, spec, func(ref name.Reference, opts ...remote.Option) error {
+		var err error
+		desc, err = remote.Head(ref, opts...)
+		return err
+	})
+	if err != nil {
+		log.Warnf("failed to resolve `%v`, fetch it instead: %v", fetchRef.Name(), err)
+	} else {
+		img, _, err := findCachedImage(p, matcher, desc.Digest)
+		if err != nil {
+			return nil, v1.Hash{}, err
+		}
+		if img != nil {
+			log.Infof("`%v` `%v` didn't change, use cached image", fetchRef.Name(), platform.String())
+			return img, desc.Digest, nil
+		}
 	}
 
-	log.Infof("fetch `%v` `%v` from remote", ref.Name(), platform.String())
+	log.Infof("fetch `%v` `%v` from remote", fetchRef.Name(), platform.String())
 
-	rmt, err := remote.Get(ref, remote.WithPlatform(platform))
+	var rmt *remote.Descriptor
+	err = remoteDo(log, fetchRef, spec, func(ref name.Reference, opts ...remote.Option) error {
+		var err error
+		rmt, err = remote.Get(ref, append(opts, remote.WithPlatform(platform))...)
+		return err
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to get remote: %w", err)
+		return nil, v1.Hash{}, fmt.Errorf("failed to get remote: %w", err)
 	}
 
 	remote_img, err := rmt.Image()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get remote image: %w", err)
+		return nil, v1.Hash{}, fmt.Errorf("failed to get remote image: %w", err)
+	}
+
+	err = fetchImageBlobs(p, remote_img)
+	if err != nil {
+		return nil, v1.Hash{}, fmt.Errorf("failed to fetch image: %w", err)
 	}
 
+	layoutMutex.Lock()
+	defer layoutMutex.Unlock()
+
+	// all blobs exist already, so this only updates the index
 	opts := []layout.Option{}
 	opts = append(opts, layout.WithAnnotations(map[string]string{
 		imagespec.AnnotationRefName: ref.Name(),
+		annotationFetchRef:          fetchRef.Name(),
+		annotationRemoteDigest:      rmt.Digest.String(),
 	}))
 	if err = p.ReplaceImage(remote_img, matcher, opts...); err != nil {
-		return nil, fmt.Errorf("failed to replace OCI image: %w", err)
+		return nil, v1.Hash{}, fmt.Errorf("failed to replace OCI image: %w", err)
 	}
 
 	ii, err := p.ImageIndex()
 	if err != nil {
-		return nil, fmt.Errorf("failed to read image index: %w", err)
+		return nil, v1.Hash{}, fmt.Errorf("failed to read image index: %w", err)
 	}
 
 	images, err := partial.FindImages(ii, matcher)
 	if err != nil {
-		return nil, fmt.Errorf("failed to search through image index: %w", err)
+		return nil, v1.Hash{}, fmt.Errorf("failed to search through image index: %w", err)
 	}
 	if len(images) < 1 {
-		return nil, fmt.Errorf("BUG: can't find the image we just pulled: `%v` `%v`", ref.Name(), platform.String())
-	}
-
-	return images[0], nil
-}
-
-func currentPlatform() v1.Platform {
-	return v1.Platform{
-		Architecture: runtime.GOARCH,
-		OS:           runtime.GOOS,
+		return nil, v1.Hash{}, fmt.Errorf("BUG: can't find the image we just pulled: `%v` `%v`", ref.Name(), platform.String())
 	}
-}
 
-type ImageSpec struct {
-	Image             string
-	DisableSupervisor bool `yaml:"disable_supervisor"`
+	return images[0], rmt.Digest, nil
 }
 
-func getImage(ociDir string, spec ImageSpec) (v1.Image, error) {
-	platform := currentPlatform()
-
-	ref, err := name.ParseReference(spec.Image)
+// fetchImageBlobs downloads the blobs of `img` into a private layout and moves
+// them into `p` afterwards. The layout would write them directly to their
+// final path, where other jobs could read incomplete blobs.
+func fetchImageBlobs(p layout.Path, img v1.Image) error {
+	tmpDir, err := os.MkdirTemp(string(p), fetchTmpPrefix)
 	if err != nil {
-		return nil, fmt.Errorf("parsing reference %q: %w", spec.Image, err)
+		return fmt.Errorf("failed to create temp dir: %w", err)
 	}
+	defer os.RemoveAll(tmpDir)
 
-	p, err := layout.FromPath(ociDir)
+	staging, err := layout.Write(tmpDir, empty.Index)
 	if err != nil {
-		p, err = layout.Write(ociDir, empty.Index)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create empty layout: %w", err)
-		}
+		return fmt.Errorf("failed to create temp layout: %w", err)
 	}
 
-	img, err := getImageRemote(p, ref, platform)
+	err = staging.WriteImage(img)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get image: %w", err)
+		return err
 	}
 
-	return img, nil
-}
+	blobDir := filepath.Join(tmpDir, "blobs")
+	return filepath.WalkDir(blobDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
 
-func generateRootfsTarCreate(dstPath string, img v1.Image, name string, spec ImageSpec) error {
-	dst, err := os.Create(dstPath)
-	if err != nil {
-		return fmt.Errorf("failed to create file: %w", err)
-	}
-	defer dst.Close()
+		relpath, err := filepath.Rel(blobDir, path)
+		if err != nil {
+			return err
+		}
 
-	err = generateRootfsTar(img, dst, name, spec)
-	if err != nil {
-		return fmt.Errorf("failed to generate rootfs: %w", err)
-	}
+		// blobs are content-addressed, so replacing an existing one is fine
+		dst := filepath.Join(string(p), "blobs", relpath)
+		err = os.MkdirAll(filepath.Dir(dst), os.ModePerm)
+		if err != nil {
+			return err
+		}
 
-	return nil
+		return os.Rename(path, dst)
+	})
 }
 
-func generateRootfsGzip(dstPath string, img v1.Image, name string, spec ImageSpec) error {
-	dst, err := os.Create(dstPath)
+// findCachedImage returns the image from the cache which matches `matcher` and
+// was fetched when the reference resolved to `digest`, or any matching image
+// if `digest` is zero, and the digest the reference resolved to. It returns nil
+// if there isn't one.
+func findCachedImage(p layout.Path, matcher match.Matcher, digest v1.Hash) (v1.Image, v1.Hash, error) {
+	layoutMutex.Lock()
+	defer layoutMutex.Unlock()
+
+	ii, err := p.ImageIndex()
 	if err != nil {
-		return fmt.Errorf("failed to create file: %w", err)
+		return nil, v1.Hash{}, fmt.Errorf("failed to read image index: %w", err)
 	}
-	defer dst.Close()
-
-	gzipWriter := gzip.NewWriter(dst)
-	defer gzipWriter.Close()
 
-	err = generateRootfsTar(img, gzipWriter, name, spec)
+	indexManifest, err := ii.IndexManifest()
 	if err != nil {
-		return fmt.Errorf("failed to generate rootfs: %w", err)
+		return nil, v1.Hash{}, fmt.Errorf("failed to open index-manifest: %w", err)
 	}
 
-	return nil
-}
+	for _, desc := range indexManifest.Manifests {
+		if !matcher(desc) {
+			continue
+		}
 
-func generateRootfsSquashfs(dst string, img v1.Image, name string, spec ImageSpec) error {
-	cmd := exec.Command("sqfstar", dst)
-	cmd.Stderr = os.Stderr
+		// images which aren't part of an index don't need the annotation
+		if digest != (v1.Hash{}) && desc.Annotations[annotationRemoteDigest] != digest.String() && desc.Digest != digest {
+			continue
+		}
 
-	stdin, err := cmd.StdinPipe()
+		img, err := ii.Image(desc.Digest)
+		if err != nil {
+			return nil, v1.Hash{}, fmt.Errorf("failed to read cached image: %w", err)
+		}
 
-	go func() {
-		err := generateRootfsTar(img, stdin, name, spec)
-		stdin.Close()
+		remoteDigest, err := v1.NewHash(desc.Annotations[annotationRemoteDigest])
 		if err != nil {
-			log.Fatalf("failed to generate rootfs tar: %w", err)
+			remoteDigest = desc.Digest
 		}
-	}()
 
-	err = cmd.Run()
-	if err != nil {
-		return fmt.Errorf("failed to write squashfs to file: %w", err)
+		return img, remoteDigest, nil
 	}
 
-	return nil
+	return nil, v1.Hash{}, nil
 }
 
-func hashToV1(hash []byte) v1.Hash {
-	return v1.Hash{
-		Algorithm: "sha256",
-		Hex:       hex.EncodeToString(hash),
+func currentPlatform() v1.Platform {
+	return v1.Platform{
+		Architecture: runtime.GOARCH,
+		OS:           runtime.GOOS,
 	}
 }
 
-func hashToV1Sized(hash [32]byte) v1.Hash {
-	return hashToV1(hash[:])
+type ImageSpec struct {
+	Image string
+	// only use this digest of `image`, e.g. `sha256:...`
+	Digest            string
+	TagPolicy         *TagPolicy `yaml:"tag_policy"`
+	DisableSupervisor bool       `yaml:"disable_supervisor"`
+	User              string
+	Auth              string
+	Refresh           time.Duration
+	Platforms         []string
+	Ports             map[string]string
+	Volumes           map[string]string
+	Restart           string
+	StopSignal        string        `yaml:"stop_signal"`
+	StopTimeout       time.Duration `yaml:"stop_timeout"`
+	RestartUnhealthy  bool          `yaml:"restart_unhealthy"`
+	Entrypoint        []string
+	Cmd               []string
+	// a value of null removes the variable from the OCI image's environment
+	Env        map[string]*string
+	Workdir    string
+	ArgsAppend []string `yaml:"args_append"`
+	Files      []SpecFile
+	Run        []string
+	RunNetwork bool `yaml:"run_network"`
+
+	// directory of the spec file
+	dir string
+	// tag selected by the tag policy
+	tag string
 }
 
-func hashFile(path string) (*v1.Hash, error) {
-	input, err := os.Open(path)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open `%s` for hashing: %w", path, err)
+var envNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// applySpecConfig returns a copy of `config` with the overrides of the spec
+// applied. Like `docker run --entrypoint`, overriding the entrypoint drops
+// the OCI image's cmd.
+func applySpecConfig(config *v1.Config, spec ImageSpec) *v1.Config {
+	result := *config
+
+	if spec.Entrypoint != nil {
+		result.Entrypoint = spec.Entrypoint
+		result.Cmd = nil
 	}
-	defer input.Close()
+	if spec.Cmd != nil {
+		result.Cmd = spec.Cmd
+	}
+	result.Cmd = append(append([]string{}, result.Cmd...), spec.ArgsAppend...)
 
-	hash := sha256.New()
-	if _, err := io.Copy(hash, input); err != nil {
-		return nil, fmt.Errorf("failed to read `%s` for hashing: %w", path, err)
+	if spec.Workdir != "" {
+		result.WorkingDir = spec.Workdir
 	}
 
-	v1hash := hashToV1(hash.Sum(nil))
-	return &v1hash, nil
+	// overridden variables keep their position, new ones are appended
+	result.Env = []string{}
+	merged := map[string]bool{}
+	for _, keyval := range config.Env {
+		key := strings.Split(keyval, "=")[0]
+		if value, ok := spec.Env[key]; ok {
+			merged[key] = true
+			if value == nil {
+				continue
+			}
+
+			keyval = fmt.Sprintf("%s=%s", key, *value)
+		}
+
+		result.Env = append(result.Env, keyval)
+	}
+	for _, key := range sortedKeys(spec.Env) {
+		if value := spec.Env[key]; value != nil && !merged[key] {
+			result.Env = append(result.Env, fmt.Sprintf("%s=%s", key, *value))
+		}
+	}
+
+	return &result
 }
 
-func removeUnusedLxdMetadata(usedLxdMetadata map[string]bool, imageDir string) error {
-	files, err := ioutil.ReadDir(imageDir)
+// validate catches errors in the spec before we fetch anything
+func (spec ImageSpec) validate() error {
+	_, err := spec.parsePlatforms()
 	if err != nil {
-		return fmt.Errorf("failed to read images dir: %w", err)
+		return err
 	}
 
-	for _, file := range files {
-		if file.IsDir() {
-			continue
+	if spec.TagPolicy != nil {
+		if spec.Digest != "" {
+			return fmt.Errorf("tag policies can't be combined with a digest")
 		}
 
-		name := filepath.Base(file.Name())
-		ext := filepath.Ext(file.Name())
+		if _, err := name.NewRepository(spec.Image); err != nil {
+			return fmt.Errorf("image needs to be a repository without tag for tag policies: %w", err)
+		}
 
-		if ext != ".yaml" {
-			continue
+		err = spec.TagPolicy.validate()
+		if err != nil {
+			return err
+		}
+	} else {
+		_, err = spec.fetchReference()
+		if err != nil {
+			return err
 		}
+	}
 
-		if _, ok := usedLxdMetadata[name]; ok {
-			continue
+	for key := range spec.Env {
+		if !envNameRegexp.MatchString(key) {
+			return fmt.Errorf("invalid name of environment variable `%s`", key)
 		}
+	}
 
-		log.Debugf("delete unused metadata `%s`", name)
-		err = os.Remove(filepath.Join(imageDir, file.Name()))
-		if err != nil {
-			return fmt.Errorf("failed to delete unused metadata `%s`: %w", name, err)
+	for _, file := range spec.Files {
+		if err := file.validate(); err != nil {
+			return err
 		}
 	}
 
-	return nil
-}
+	if spec.Workdir != "" && !filepath.IsAbs(spec.Workdir) {
+		return fmt.Errorf("workdir `%s` isn't an absolute path", spec.Workdir)
+	}
 
-func removeUnusedLxdImages(usedLxdImages map[string]bool, imageDir string) error {
-	files, err := ioutil.ReadDir(imageDir)
+	policy, err := parseRestartPolicy(spec.Restart)
 	if err != nil {
-		return fmt.Errorf("failed to read images dir: %w", err)
+		return err
+	}
+	if spec.DisableSupervisor && policy.name != restartNo {
+		return fmt.Errorf("restart policies need the supervisor")
 	}
 
-	for _, file := range files {
-		if file.IsDir() {
-			continue
-		}
-
-		name := filepath.Base(file.Name())
-		ext := filepath.Ext(file.Name())
+	if spec.RestartUnhealthy && spec.DisableSupervisor {
+		return fmt.Errorf("restarting unhealthy entrypoints needs the supervisor")
+	}
 
-		if ext != ".rootfs" {
-			continue
+	if spec.StopSignal != "" {
+		if spec.DisableSupervisor {
+			return fmt.Errorf("stop signals need the supervisor")
 		}
 
-		if _, ok := usedLxdImages[name]; ok {
-			continue
+		_, err = parseStopSignal(spec.StopSignal)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parsePlatforms returns the platforms to build images for. The OS is optional
+// since LXD only runs linux containers anyway.
+func (spec ImageSpec) parsePlatforms() ([]v1.Platform, error) {
+	if len(spec.Platforms) == 0 {
+		return []v1.Platform{currentPlatform()}, nil
+	}
+
+	platforms := []v1.Platform{}
+	for _, s := range spec.Platforms {
+		if !strings.HasPrefix(s, "linux/") {
+			s = "linux/" + s
+		}
+
+		platform, err := v1.ParsePlatform(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid platform `%s`: %w", s, err)
+		}
+
+		if _, err := common.LxdArchitecture(*platform); err != nil {
+			return nil, err
+		}
+
+		platforms = append(platforms, *platform)
+	}
+
+	return platforms, nil
+}
+
+// metadataStem returns the filename of the metadata without extension.
+// Specs without platforms keep the name they had before multi-arch support.
+func (spec ImageSpec) metadataStem(name string, platform v1.Platform) string {
+	if len(spec.Platforms) == 0 {
+		return name
+	}
+
+	return fmt.Sprintf("%s_%s%s", name, platform.Architecture, platform.Variant)
+}
+
+// reference returns the reference of `image`, using the tag selected by the
+// tag policy if there's one
+func (spec ImageSpec) reference() (name.Reference, error) {
+	if spec.TagPolicy == nil {
+		ref, err := name.ParseReference(spec.Image)
+		if err != nil {
+			return nil, fmt.Errorf("parsing reference %q: %w", spec.Image, err)
+		}
+
+		return ref, nil
+	}
+
+	if spec.tag == "" {
+		return nil, fmt.Errorf("BUG: tag of `%s` wasn't resolved", spec.Image)
+	}
+
+	repo, err := name.NewRepository(spec.Image)
+	if err != nil {
+		return nil, fmt.Errorf("parsing repository %q: %w", spec.Image, err)
+	}
+
+	return repo.Tag(spec.tag), nil
+}
+
+// fetchReference returns what we actually fetch for `image`, which is the
+// pinned digest if there's one
+func (spec ImageSpec) fetchReference() (name.Reference, error) {
+	ref, err := spec.reference()
+	if err != nil {
+		return nil, err
+	}
+
+	if spec.Digest == "" {
+		return ref, nil
+	}
+
+	if _, ok := ref.(name.Digest); ok {
+		return nil, fmt.Errorf("`%s` already contains a digest", spec.Image)
+	}
+
+	if _, err := v1.NewHash(spec.Digest); err != nil {
+		return nil, fmt.Errorf("invalid digest `%s`: %w", spec.Digest, err)
+	}
+
+	return ref.Context().Digest(spec.Digest), nil
+}
+
+// getImage returns the image of the spec and the digest its reference
+// resolved to in the registry
+func getImage(log *zap.SugaredLogger, ociDir string, spec ImageSpec, platform v1.Platform) (v1.Image, v1.Hash, error) {
+	ref, err := spec.reference()
+	if err != nil {
+		return nil, v1.Hash{}, err
+	}
+
+	fetchRef, err := spec.fetchReference()
+	if err != nil {
+		return nil, v1.Hash{}, err
+	}
+
+	layoutMutex.Lock()
+	p, err := layout.FromPath(ociDir)
+	if err != nil {
+		p, err = layout.Write(ociDir, empty.Index)
+	}
+	layoutMutex.Unlock()
+	if err != nil {
+		return nil, v1.Hash{}, fmt.Errorf("failed to create empty layout: %w", err)
+	}
+
+	img, remoteDigest, err := getImageRemote(log, p, ref, fetchRef, platform, spec)
+	if err != nil {
+		return nil, v1.Hash{}, fmt.Errorf("failed to get image: %w", err)
+	}
+
+	return img, remoteDigest, nil
+}
+
+func generateRootfsTarCreate(log *zap.SugaredLogger, dstPath string, img v1.Image, name string, spec ImageSpec) error {
+	dst, err := os.Create(dstPath)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer dst.Close()
+
+	err = generateRootfsTar(log, img, dst, name, spec)
+	if err != nil {
+		return fmt.Errorf("failed to generate rootfs: %w", err)
+	}
+
+	return nil
+}
+
+func generateRootfsGzip(log *zap.SugaredLogger, dstPath string, img v1.Image, name string, spec ImageSpec) error {
+	dst, err := os.Create(dstPath)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer dst.Close()
+
+	gzipWriter := gzip.NewWriter(dst)
+	defer gzipWriter.Close()
+
+	err = generateRootfsTar(log, img, gzipWriter, name, spec)
+	if err != nil {
+		return fmt.Errorf("failed to generate rootfs: %w", err)
+	}
+
+	return nil
+}
+
+func generateRootfsSquashfs(log *zap.SugaredLogger, dstPath string, img v1.Image, name string, spec ImageSpec) error {
+	dst, err := os.Create(dstPath)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer dst.Close()
+
+	squashfsWriter, err := NewSquashfsWriter(log, dst, squashfsCompression)
+	if err != nil {
+		return fmt.Errorf("failed to create squashfs writer: %w", err)
+	}
+
+	err = generateRootfs(log, img, squashfsWriter, name, spec)
+	if err != nil {
+		squashfsWriter.Abort()
+		return fmt.Errorf("failed to generate rootfs: %w", err)
+	}
+
+	err = squashfsWriter.Close()
+	if err != nil {
+		return fmt.Errorf("failed to write squashfs: %w", err)
+	}
+
+	return nil
+}
+
+func hashToV1(hash []byte) v1.Hash {
+	return v1.Hash{
+		Algorithm: "sha256",
+		Hex:       hex.EncodeToString(hash),
+	}
+}
+
+func hashToV1Sized(hash [32]byte) v1.Hash {
+	return hashToV1(hash[:])
+}
+
+func hashFile(path string) (*v1.Hash, error) {
+	input, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open `%s` for hashing: %w", path, err)
+	}
+	defer input.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, input); err != nil {
+		return nil, fmt.Errorf("failed to read `%s` for hashing: %w", path, err)
+	}
+
+	v1hash := hashToV1(hash.Sum(nil))
+	return &v1hash, nil
+}
+
+func removeUnusedLxdMetadata(usedLxdMetadata map[string]bool, imageDir string) error {
+	files, err := ioutil.ReadDir(imageDir)
+	if err != nil {
+		return fmt.Errorf("failed to read images dir: %w", err)
+	}
+
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+
+		name := filepath.Base(file.Name())
+		ext := filepath.Ext(file.Name())
+
+		// profiles belong to the metadata with the same name
+		metadataName := name
+		switch ext {
+		case ".meta":
+		case ".profile":
+			metadataName = strings.TrimSuffix(name, ext) + ".meta"
+		default:
+			continue
+		}
+
+		if _, ok := usedLxdMetadata[metadataName]; ok {
+			continue
+		}
+
+		log.Debugf("delete unused metadata `%s`", name)
+		err = os.Remove(filepath.Join(imageDir, file.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to delete unused metadata `%s`: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+func removeUnusedLxdImages(usedLxdImages map[string]bool, imageDir string) error {
+	files, err := ioutil.ReadDir(imageDir)
+	if err != nil {
+		return fmt.Errorf("failed to read images dir: %w", err)
+	}
+
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+
+		name := filepath.Base(file.Name())
+		ext := filepath.Ext(file.Name())
+
+		if ext != ".rootfs" {
+			continue
+		}
+
+		if _, ok := usedLxdImages[name]; ok {
+			continue
 		}
 
 		log.Debugf("delete unused rootfs `%s`", name)
@@ -711,16 +1296,201 @@ func removeUnusedOciImages(usedOciImages map[v1.Hash]bool, ociDir string) error
 	return nil
 }
 
-func updateAll(ociDir string, specDir string, imageDir string) error {
+// pruneHistory drops old versions which are neither one of the newest
+// `--keep-versions` nor younger than `--max-age`.
+func pruneHistory(history []common.RootfsVersion) []common.RootfsVersion {
+	kept := []common.RootfsVersion{}
+
+	for i, version := range history {
+		// the current version counts as well
+		if i+1 < keepVersions || (maxAge > 0 && time.Since(version.Created) < maxAge) {
+			kept = append(kept, version)
+		}
+	}
+
+	return kept
+}
+
+func writeRootfsMetadata(imageDir string, metadataFilename string, metadata *common.RootfsMetadata) error {
+	lock, err := lockMetadata(imageDir)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	file, err := os.CreateTemp(imageDir, metadataFilename)
+	if err != nil {
+		return fmt.Errorf("failed to open temp metadata file: %w", err)
+	}
+
+	err = yaml.NewEncoder(file).Encode(metadata)
+	file.Close()
+	if err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("failed to encode metadata: %w", err)
+	}
+
+	// atomically replace old metadata
+	err = os.Rename(file.Name(), filepath.Join(imageDir, metadataFilename))
+	if err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("failed to rename metadata: %w", err)
+	}
+
+	return nil
+}
+
+type updateMode int
+
+const (
+	// keep the current version
+	updateSkip updateMode = iota
+	// update if the spec or the OCI image changed
+	updateCheck
+	// regenerate the rootfs even if nothing changed
+	updateForce
+)
+
+// updateFilter decides which specs updateAll processes
+type updateFilter func(name string, spec ImageSpec, specHash v1.Hash) updateMode
+
+func updateEverything(name string, spec ImageSpec, specHash v1.Hash) updateMode {
+	return updateCheck
+}
+
+// keepOldVersions marks everything the current metadata of an image refers to
+// as used, so it survives the garbage collection.
+func keepOldVersions(log *zap.SugaredLogger, metadataFilepath string, usedOciImages map[v1.Hash]bool, usedLxdImages map[string]bool) {
+	oldRootMeta, err := common.ReadRootfsMetaData(metadataFilepath)
+	if err != nil {
+		log.Debugf("old metadata not read: %v", err)
+		return
+	}
+
+	usedOciImages[oldRootMeta.OciImageDigest] = true
+	for _, version := range oldRootMeta.Versions() {
+		usedLxdImages[version.Filename] = true
+	}
+}
+
+// cachedTag returns the tag the tag policy of spec `name` selected last time
+func cachedTag(imageDir string, name string) (string, error) {
+	files, err := filepath.Glob(filepath.Join(imageDir, "*.meta"))
+	if err != nil {
+		return "", fmt.Errorf("failed to list metadata: %w", err)
+	}
+
+	for _, path := range files {
+		rootMeta, err := common.ReadRootfsMetaData(path)
+		if err != nil || rootMeta.SpecName(path) != name {
+			continue
+		}
+
+		if rootMeta.Tag != "" {
+			return rootMeta.Tag, nil
+		}
+	}
+
+	return "", fmt.Errorf("no tag of `%s` was selected before", name)
+}
+
+// keepSpecMetadata marks all metadata of spec `name` as used. This is for
+// specs we didn't look at closely, e.g. because they failed to parse.
+func keepSpecMetadata(log *zap.SugaredLogger, imageDir string, name string, usedLxdMetadata map[string]bool, usedOciImages map[v1.Hash]bool, usedLxdImages map[string]bool) {
+	files, err := filepath.Glob(filepath.Join(imageDir, "*.meta"))
+	if err != nil {
+		log.Debugf("failed to list metadata: %v", err)
+		return
+	}
+
+	for _, path := range files {
+		rootMeta, err := common.ReadRootfsMetaData(path)
+		if err != nil {
+			continue
+		}
+
+		if rootMeta.SpecName(path) != name {
+			continue
+		}
+
+		usedLxdMetadata[filepath.Base(path)] = true
+		keepOldVersions(log, path, usedOciImages, usedLxdImages)
+	}
+}
+
+// removeUnusedLxd deletes LXD metadata and images that aren't used anymore.
+// imgserver doesn't see any of them while we're doing that.
+func removeUnusedLxd(usedLxdMetadata map[string]bool, usedLxdImages map[string]bool, imageDir string) error {
+	lock, err := lockMetadata(imageDir)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	log.Infof("delete unused LXD metadata")
+	err = removeUnusedLxdMetadata(usedLxdMetadata, imageDir)
+	if err != nil {
+		return fmt.Errorf("failed to delete unused LXD metadata: %w", err)
+	}
+
+	log.Infof("delete unused LXD images")
+	err = removeUnusedLxdImages(usedLxdImages, imageDir)
+	if err != nil {
+		return fmt.Errorf("failed to delete unused LXD images: %w", err)
+	}
+
+	return nil
+}
+
+// updateAll updates all specs in `specDir` and deletes everything that isn't
+// used anymore. It returns the result of every spec, even if deleting failed.
+func updateAll(ociDir string, specDir string, imageDir string, filter updateFilter) ([]specReport, error) {
 	var usedOciImages = map[v1.Hash]bool{}
 	var usedLxdImages = map[string]bool{}
 	var usedLxdMetadata = map[string]bool{}
+	var results = []specReport{}
 
+	specPaths, err := listSpecs(specDir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, job := range runSpecJobs(ociDir, specPaths, imageDir, filter) {
+		for key := range job.usedLxdMetadata {
+			usedLxdMetadata[key] = true
+		}
+		for key := range job.usedOciImages {
+			usedOciImages[key] = true
+		}
+		for key := range job.usedLxdImages {
+			usedLxdImages[key] = true
+		}
+
+		results = append(results, job.report)
+	}
+
+	err = removeUnusedLxd(usedLxdMetadata, usedLxdImages, imageDir)
+	if err != nil {
+		return results, err
+	}
+
+	log.Infof("delete unused OCI images")
+	err = removeUnusedOciImages(usedOciImages, ociDir)
+	if err != nil {
+		return results, fmt.Errorf("failed to delete unused OCI images: %w", err)
+	}
+
+	return results, nil
+}
+
+// listSpecs returns the paths of all spec files in `specDir`
+func listSpecs(specDir string) ([]string, error) {
 	files, err := ioutil.ReadDir(specDir)
 	if err != nil {
-		return fmt.Errorf("failed to open imagespec dir `%s`: %w", specDir, err)
+		return nil, fmt.Errorf("failed to open imagespec dir `%s`: %w", specDir, err)
 	}
 
+	paths := []string{}
 	for _, file := range files {
 		if file.IsDir() {
 			continue
@@ -731,161 +1501,304 @@ func updateAll(ociDir string, specDir string, imageDir string) error {
 			continue
 		}
 
-		name := strings.TrimSuffix(filepath.Base(file.Name()), ext)
-		metadataFilename := fmt.Sprintf("%s.meta", name)
-		metadataFilepath := filepath.Join(imageDir, metadataFilename)
+		paths = append(paths, filepath.Join(specDir, file.Name()))
+	}
 
-		usedLxdMetadata[name] = true
+	return paths, nil
+}
 
-		// XXX: we read it into RAM instead of opening a reader so we can be sure
-		//      the hash is of the data we parsed when somebody writes to the file
-		//      while we're reading
-		specBytes, err := ioutil.ReadFile(filepath.Join(specDir, file.Name()))
-		if err != nil {
-			log.Errorf("failed to read spec file `%v`: %w", name, err)
-			continue
-		}
-		specHash := hashToV1Sized(sha256.Sum256(specBytes))
+// specName returns the image name of a spec file
+func specName(specPath string) string {
+	return strings.TrimSuffix(filepath.Base(specPath), filepath.Ext(specPath))
+}
 
-		// parse image spec
-		spec := ImageSpec{}
+// readSpec parses and validates a spec file. It also returns the raw contents
+// for hashing.
+func readSpec(specPath string) (ImageSpec, []byte, error) {
+	// XXX: we read it into RAM instead of opening a reader so we can be sure
+	//      the hash is of the data we parsed when somebody writes to the file
+	//      while we're reading
+	specBytes, err := ioutil.ReadFile(specPath)
+	if err != nil {
+		return ImageSpec{}, nil, fmt.Errorf("failed to read spec file: %w", err)
+	}
 
-		decoder := yaml.NewDecoder(bytes.NewReader(specBytes))
-		decoder.KnownFields(true)
+	// parse image spec
+	spec := ImageSpec{dir: filepath.Dir(specPath)}
 
-		err = decoder.Decode(&spec)
-		if err != nil {
-			log.Errorf("failed to parse `%v`: %w", name, err)
-			continue
-		}
+	decoder := yaml.NewDecoder(bytes.NewReader(specBytes))
+	decoder.KnownFields(true)
 
-		img, err := getImage(ociDir, spec)
-		if err != nil {
-			log.Errorf("failed to update `%v`: %w", name, err)
-			continue
-		}
+	err = decoder.Decode(&spec)
+	if err == nil {
+		err = spec.validate()
+	}
+	if err != nil {
+		return ImageSpec{}, nil, fmt.Errorf("failed to parse spec: %w", err)
+	}
 
-		ociHash, err := img.Digest()
-		if err != nil {
-			log.Errorf("failed to hash oci for `%v`: %w", name, err)
-			continue
-		}
+	return spec, specBytes, nil
+}
 
-		oldRootMeta, err := common.ReadRootfsMetaData(metadataFilepath)
-		if err == nil {
-			// we already have an LXD image, check if we need to update
+// updateSpec updates the images of a single spec, marks everything it uses and
+// adds the result of every platform to `report`. It returns true if the filter
+// skipped it.
+func updateSpec(log *zap.SugaredLogger, output io.Writer, ociDir string, specPath string, imageDir string, name string, filter updateFilter, report *specReport, usedLxdMetadata map[string]bool, usedOciImages map[v1.Hash]bool, usedLxdImages map[string]bool) (bool, error) {
+	spec, specBytes, err := readSpec(specPath)
+	if err != nil {
+		keepSpecMetadata(log, imageDir, name, usedLxdMetadata, usedOciImages, usedLxdImages)
+		return false, err
+	}
 
-			if oldRootMeta.SpecDigest == specHash && oldRootMeta.OciImageDigest == ociHash {
-				log.Infof("`%v` didn't change, skip", name)
+	specHash, err := hashSpecFiles(specBytes, spec)
+	if err != nil {
+		keepSpecMetadata(log, imageDir, name, usedLxdMetadata, usedOciImages, usedLxdImages)
+		return false, err
+	}
 
-				usedOciImages[ociHash] = true
-				usedLxdImages[oldRootMeta.Filename] = true
+	mode := filter(name, spec, specHash)
+	if mode == updateSkip {
+		keepSpecMetadata(log, imageDir, name, usedLxdMetadata, usedOciImages, usedLxdImages)
+		return true, nil
+	}
 
-				continue
-			}
+	if spec.TagPolicy != nil {
+		if offline {
+			spec.tag, err = cachedTag(imageDir, name)
 		} else {
-			log.Debugf("old metadata not read: %w", err)
+			spec.tag, err = resolveTag(log, spec)
 		}
+		if err != nil {
+			keepSpecMetadata(log, imageDir, name, usedLxdMetadata, usedOciImages, usedLxdImages)
+			return false, err
+		}
+	}
+	report.Tag = spec.tag
 
-		// write rootfs
-		rootfsPathTemp := filepath.Join(imageDir, fmt.Sprintf("%s.rootfs.tmp", name))
-		if _, err := os.Stat(rootfsPathTemp); err == nil {
-			err = os.Remove(rootfsPathTemp)
-			if err != nil {
-				log.Errorf("failed to delete old tmp rootfs from `%v`: %w", rootfsPathTemp, err)
-				continue
+	platforms, _ := spec.parsePlatforms()
+
+	// a failing platform shouldn't prevent updates of the other ones
+	failures := []string{}
+	for _, platform := range platforms {
+		report.Platforms = append(report.Platforms, platformReport{Platform: platform.String()})
+		platformReport := &report.Platforms[len(report.Platforms)-1]
+
+		err = updatePlatform(log, output, ociDir, imageDir, name, spec, specHash, platform, mode, platformReport, usedLxdMetadata, usedOciImages, usedLxdImages)
+		if err != nil {
+			platformReport.Status = reportFailed
+			platformReport.Error = err.Error()
+
+			// keep serving the previous version, e.g. if the registry is
+			// unreachable
+			metadataFilepath := filepath.Join(imageDir, fmt.Sprintf("%s.meta", spec.metadataStem(name, platform)))
+			keepOldVersions(log, metadataFilepath, usedOciImages, usedLxdImages)
+
+			if len(platforms) == 1 {
+				return false, err
 			}
+
+			log.Errorf("failed to update `%v` for `%v`: %v", name, platform.String(), err)
+			failures = append(failures, platform.String())
 		}
+	}
 
-		log.Infof("generate rootfs at %v", rootfsPathTemp)
-		switch imageFormat {
-		case "squashfs":
-			err = generateRootfsSquashfs(rootfsPathTemp, img, name, spec)
-			if err != nil {
-				log.Errorf("failed to generate rootfs for `%v`: %w", name, err)
-				continue
-			}
-		case "gzip":
-			err = generateRootfsGzip(rootfsPathTemp, img, name, spec)
-			if err != nil {
-				log.Errorf("failed to generate rootfs for `%v`: %w", name, err)
-				continue
+	if len(failures) > 0 {
+		return false, fmt.Errorf("failed to update platforms: %s", strings.Join(failures, ", "))
+	}
+
+	return false, nil
+}
+
+// updatePlatform updates the image of a spec for a single platform and
+// records the old and new digests in `report`
+func updatePlatform(log *zap.SugaredLogger, output io.Writer, ociDir string, imageDir string, name string, spec ImageSpec, specHash v1.Hash, platform v1.Platform, mode updateMode, report *platformReport, usedLxdMetadata map[string]bool, usedOciImages map[v1.Hash]bool, usedLxdImages map[string]bool) error {
+	stem := spec.metadataStem(name, platform)
+	metadataFilename := fmt.Sprintf("%s.meta", stem)
+	metadataFilepath := filepath.Join(imageDir, metadataFilename)
+	usedLxdMetadata[metadataFilename] = true
+
+	img, remoteDigest, err := getImage(log, ociDir, spec, platform)
+	if err != nil {
+		return err
+	}
+
+	ociHash, err := img.Digest()
+	if err != nil {
+		return fmt.Errorf("failed to hash oci: %w", err)
+	}
+	report.NewOciDigest = ociHash.String()
+
+	configFile, err := img.ConfigFile()
+	if err != nil {
+		return fmt.Errorf("retrieving image config file: %w", err)
+	}
+
+	oldRootMeta, err := common.ReadRootfsMetaData(metadataFilepath)
+	if err == nil {
+		report.OldOciDigest = oldRootMeta.OciImageDigest.String()
+		report.OldRootfsDigest = oldRootMeta.LxdImageDigest.String()
+
+		// we already have an LXD image, check if we need to update
+
+		if mode != updateForce && oldRootMeta.SpecDigest == specHash && oldRootMeta.OciImageDigest == ociHash && oldRootMeta.Tag == spec.tag {
+			log.Infof("`%v` didn't change, skip", stem)
+			report.Status = reportUnchanged
+			report.NewRootfsDigest = oldRootMeta.LxdImageDigest.String()
+
+			usedOciImages[ociHash] = true
+
+			// old versions might have expired since the last run, and
+			// `outdated` needs the digest even if only other platforms of
+			// the image changed
+			versions := oldRootMeta.Versions()
+			history := pruneHistory(oldRootMeta.History)
+			if len(history) != len(oldRootMeta.History) || oldRootMeta.RemoteDigest != remoteDigest {
+				oldRootMeta.History = history
+				oldRootMeta.RemoteDigest = remoteDigest
+
+				err = writeRootfsMetadata(imageDir, metadataFilename, oldRootMeta)
+				if err != nil {
+					log.Errorf("failed to write metadata for `%v`: %v", stem, err)
+				} else {
+					versions = oldRootMeta.Versions()
+				}
 			}
-		case "tar":
-			err = generateRootfsTarCreate(rootfsPathTemp, img, name, spec)
-			if err != nil {
-				log.Errorf("failed to generate rootfs for `%v`: %w", name, err)
-				continue
+
+			for _, version := range versions {
+				usedLxdImages[version.Filename] = true
 			}
-		default:
-			log.Fatalf("unsupported rootfs format: %s", imageFormat)
+
+			// this is cheap, so always do it in case an older version of
+			// lxdocker generated the image
+			return writeProfile(imageDir, stem, name, &configFile.Config, spec)
 		}
+	} else {
+		log.Debugf("old metadata not read: %v", err)
+		oldRootMeta = nil
+	}
 
-		rootfsHash, err := hashFile(rootfsPathTemp)
+	runLayer := ""
+	if len(spec.Run) > 0 {
+		buildSlots.acquire()
+		img, runLayer, err = applyRunSteps(log, output, ociDir, img, stem, spec)
+		buildSlots.release()
 		if err != nil {
-			log.Errorf("failed to hash rootfs for `%v`: %w", name, err)
-			continue
+			return err
 		}
+	}
 
-		// XXX: the rootfs might already exist in case the metadata
-		//      changed but the result didn't. So do an atomic rename
-		rootfsFilename := fmt.Sprintf("%s-%v.rootfs", name, rootfsHash.Hex)
-		err = os.Rename(rootfsPathTemp, filepath.Join(imageDir, rootfsFilename))
+	// write rootfs
+	rootfsPathTemp := filepath.Join(imageDir, fmt.Sprintf("%s.rootfs.tmp", stem))
+	if _, err := os.Stat(rootfsPathTemp); err == nil {
+		err = os.Remove(rootfsPathTemp)
 		if err != nil {
-			log.Errorf("failed to rename rootfs for `%v`: %w", name, err)
-			continue
+			return fmt.Errorf("failed to delete old tmp rootfs from `%v`: %w", rootfsPathTemp, err)
 		}
+	}
+
+	log.Infof("generate rootfs at %v", rootfsPathTemp)
+	buildSlots.acquire()
+	switch imageFormat {
+	case "squashfs":
+		err = generateRootfsSquashfs(log, rootfsPathTemp, img, name, spec)
+	case "gzip":
+		err = generateRootfsGzip(log, rootfsPathTemp, img, name, spec)
+	case "tar":
+		err = generateRootfsTarCreate(log, rootfsPathTemp, img, name, spec)
+	default:
+		err = fmt.Errorf("unsupported rootfs format: %s", imageFormat)
+	}
+	buildSlots.release()
+	if err != nil {
+		// nothing else deletes it until the spec gets built again
+		os.Remove(rootfsPathTemp)
+		return fmt.Errorf("failed to generate rootfs: %w", err)
+	}
+
+	rootfsHash, err := hashFile(rootfsPathTemp)
+	if err != nil {
+		os.Remove(rootfsPathTemp)
+		return fmt.Errorf("failed to hash rootfs: %w", err)
+	}
+
+	// XXX: the rootfs might already exist in case the metadata
+	//      changed but the result didn't. So do an atomic rename
+	rootfsFilename := fmt.Sprintf("%s-%v.rootfs", stem, rootfsHash.Hex)
+	err = os.Rename(rootfsPathTemp, filepath.Join(imageDir, rootfsFilename))
+	if err != nil {
+		os.Remove(rootfsPathTemp)
+		return fmt.Errorf("failed to rename rootfs: %w", err)
+	}
 
-		// write metadata
-		rootMeta := common.RootfsMetadata{
+	// write metadata
+	rootMeta := common.RootfsMetadata{
+		Name:     name,
+		Platform: platform.String(),
+		RootfsVersion: common.RootfsVersion{
 			SpecDigest:     specHash,
 			OciImageDigest: ociHash,
 			LxdImageDigest: *rootfsHash,
 			Filename:       rootfsFilename,
-		}
+			Created:        time.Now().UTC(),
+			RunLayer:       runLayer,
+			Tag:            spec.tag,
+			RemoteDigest:   remoteDigest,
+		},
+	}
 
-		file, err := os.CreateTemp(imageDir, metadataFilename)
-		if err != nil {
-			log.Errorf("failed to open temp metadata file `%v`: %w", name, err)
-			continue
+	if oldRootMeta != nil {
+		// metadata of older lxdocker versions doesn't contain a date, so
+		// imgserver would use the date of the new metadata for both versions.
+		// The old metadata was written when that version was created, but make
+		// sure it ends up in an older minute than the new one.
+		created := rootMeta.Created.Truncate(time.Minute)
+		legacyCreated := created.Add(-time.Minute)
+		if info, err := os.Stat(metadataFilepath); err == nil && info.ModTime().Before(created) {
+			legacyCreated = info.ModTime().UTC()
 		}
 
-		err = yaml.NewEncoder(file).Encode(&rootMeta)
-		file.Close()
-		if err != nil {
-			log.Errorf("failed to encode metadata for `%v`: %w", name, err)
-			continue
-		}
+		for _, version := range oldRootMeta.Versions() {
+			// the spec changed but the rootfs didn't
+			if version.Filename == rootfsFilename {
+				continue
+			}
 
-		// atomically replace old metadata
-		err = os.Rename(file.Name(), metadataFilepath)
-		if err != nil {
-			log.Errorf("failed to rename metadata for `%v`: %w", name, err)
-			continue
-		}
+			if version.Created.IsZero() {
+				version.Created = legacyCreated
+			}
 
-		usedOciImages[ociHash] = true
-		usedLxdImages[rootfsFilename] = true
+			rootMeta.History = append(rootMeta.History, version)
+		}
+		rootMeta.History = pruneHistory(rootMeta.History)
 	}
 
-	log.Infof("delete unused LXD metadata")
-	err = removeUnusedLxdMetadata(usedLxdMetadata, imageDir)
+	err = writeRootfsMetadata(imageDir, metadataFilename, &rootMeta)
 	if err != nil {
-		return fmt.Errorf("failed to delete unused LXD metadata: %w", err)
+		// the old metadata is still in place
+		if oldRootMeta != nil {
+			for _, version := range oldRootMeta.Versions() {
+				usedLxdImages[version.Filename] = true
+			}
+		}
+
+		return fmt.Errorf("failed to write metadata: %w", err)
 	}
 
-	log.Infof("delete unused LXD images")
-	err = removeUnusedLxdImages(usedLxdImages, imageDir)
-	if err != nil {
-		return fmt.Errorf("failed to delete unused LXD images: %w", err)
+	usedOciImages[ociHash] = true
+	for _, version := range rootMeta.Versions() {
+		usedLxdImages[version.Filename] = true
 	}
 
-	log.Infof("delete unused OCI images")
-	err = removeUnusedOciImages(usedOciImages, ociDir)
+	// only now, so the profile never belongs to a newer image than the
+	// metadata
+	err = writeProfile(imageDir, stem, name, &configFile.Config, spec)
 	if err != nil {
-		return fmt.Errorf("failed to delete unused OCI images: %w", err)
+		return err
 	}
 
+	report.Status = reportRebuilt
+	report.NewRootfsDigest = rootfsHash.String()
+
 	return nil
 }
 
@@ -991,55 +1904,226 @@ func deleteUnusedBlobs(ociDir string, usedBlobs map[v1.Hash]bool) error {
 	return nil
 }
 
+// lockDirectory protects `dir` against concurrent lxdocker instances
+func lockDirectory(dir string) (*common.FileLock, error) {
+	path := filepath.Join(dir, common.LockFilename)
+
+	lock, err := common.LockFile(path, true, false)
+	if errors.Is(err, common.ErrLocked) && waitForLock {
+		log.Infof("`%s` is locked by another instance, waiting", dir)
+		lock, err = common.LockFile(path, true, true)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock `%s`: %w", dir, err)
+	}
+
+	return lock, nil
+}
+
+// lockMetadata protects the metadata against imgserver. It's only held for a
+// short time, so we always wait for it.
+func lockMetadata(imageDir string) (*common.FileLock, error) {
+	lock, err := common.LockFile(filepath.Join(imageDir, common.MetadataLockFilename), true, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock metadata: %w", err)
+	}
+
+	return lock, nil
+}
+
+// removeTempDirs deletes the temporary directories of fetches and build steps
+// which were interrupted
+func removeTempDirs(ociDir string) error {
+	for _, prefix := range []string{fetchTmpPrefix, runTmpPrefix} {
+		tmpDirs, err := filepath.Glob(filepath.Join(ociDir, prefix+"*"))
+		if err != nil {
+			return fmt.Errorf("failed to list temp dirs: %w", err)
+		}
+
+		for _, path := range tmpDirs {
+			log.Debugf("delete leftover `%s`", path)
+			removeTree(log, path)
+		}
+	}
+
+	return nil
+}
+
+// updateAndCollect updates all images and deletes unused blobs afterwards. The
+// results of the specs are returned even if deleting something failed.
+func updateAndCollect(ociDir string, specDir string, imageDir string, filter updateFilter) ([]specReport, error) {
+	cacheLock, err := lockDirectory(ociDir)
+	if err != nil {
+		return nil, err
+	}
+	defer cacheLock.Unlock()
+
+	imageLock, err := lockDirectory(imageDir)
+	if err != nil {
+		return nil, err
+	}
+	defer imageLock.Unlock()
+
+	log.Infof("update all images")
+	results, err := updateAll(ociDir, specDir, imageDir, filter)
+	if err != nil {
+		return results, fmt.Errorf("failed to update all images: %w", err)
+	}
+
+	log.Infof("look for and delete unused blobs")
+	usedBlobs, err := listUsedBlobs(ociDir)
+	if err != nil {
+		return results, fmt.Errorf("failed to list used blobs: %w", err)
+	}
+
+	err = deleteUnusedBlobs(ociDir, usedBlobs)
+	if err != nil {
+		return results, fmt.Errorf("failed to delete unused blobs: %w", err)
+	}
+
+	log.Infof("delete leftovers of previous runs")
+	err = removeTempDirs(ociDir)
+	if err != nil {
+		return results, err
+	}
+
+	log.Infof("delete unused layers of build steps")
+	err = removeUnusedRunLayers(ociDir, imageDir)
+	if err != nil {
+		return results, fmt.Errorf("failed to delete unused layers of build steps: %w", err)
+	}
+
+	return results, nil
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == sandboxArg {
+		sandboxMain(os.Args[2:])
+		return
+	}
+
 	log = common.MakeLogger()
 
 	var ociDir string
 	var imageDir string
 	var specDir string
+	var registryAuthPath string
+	var registryConfigPath string
+	var fetchJobs int
+	var reportPath string
+	var reportFormat string
+	var buildJobs int
 
 	var rootCmd = &cobra.Command{
 		Use:   "lxdocker",
 		Short: "generate LXD images from docker containers",
-		Run: func(cmd *cobra.Command, args []string) {
-			err := os.MkdirAll(imageDir, os.ModePerm)
-			if err != nil {
-				log.Fatalf("failed to create directory `%s`: %w", imageDir, err)
-				return
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			for _, dir := range []string{ociDir, imageDir} {
+				err := os.MkdirAll(dir, os.ModePerm)
+				if err != nil {
+					log.Fatalf("failed to create directory `%s`: %v", dir, err)
+					return
+				}
 			}
 
-			log.Infof("update all images")
-			err = updateAll(ociDir, specDir, imageDir)
-			if err != nil {
-				log.Fatalf("failed to update all images: %w", err)
+			if reportFormat != "json" && reportFormat != "yaml" {
+				log.Fatalf("unsupported report format: %s", reportFormat)
 				return
 			}
-
-			log.Infof("look for and delete unused blobs")
-			usedBlobs, err := listUsedBlobs(ociDir)
-			if err != nil {
-				log.Fatalf("failed to list used blobs: %w", err)
+			switch imageFormat {
+			case "squashfs", "gzip", "tar":
+			default:
+				log.Fatalf("unsupported rootfs format: %s", imageFormat)
 				return
 			}
+			if _, err := newSquashfsCompressor(squashfsCompression); err != nil {
+				log.Fatalf("%v", err)
+				return
+			}
+			if jobs < 1 {
+				log.Fatalf("--jobs has to be at least 1")
+				return
+			}
+			if fetchJobs == 0 {
+				fetchJobs = jobs
+			}
+			if buildJobs == 0 {
+				buildJobs = jobs
+			}
+			fetchSlots = newSlots(fetchJobs)
+			buildSlots = newSlots(buildJobs)
+
+			var err error
+
+			if registryAuthPath != "" {
+				registryCredentials, err = readRegistryCredentials(registryAuthPath)
+				if err != nil {
+					log.Fatalf("failed to read registry credentials: %v", err)
+					return
+				}
+			}
+
+			if registryConfigPath != "" {
+				registryConfigs, err = readRegistryConfigs(registryConfigPath)
+				if err != nil {
+					log.Fatalf("failed to read registry config: %v", err)
+					return
+				}
+			}
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			started := time.Now()
+			results, err := updateAndCollect(ociDir, specDir, imageDir, updateEverything)
+			report := newRunReport(started, results, err)
+
+			if reportPath != "" {
+				if reportErr := report.write(reportPath, reportFormat); reportErr != nil {
+					log.Errorf("%v", reportErr)
+					if err == nil {
+						err = reportErr
+					}
+				}
+			}
 
-			err = deleteUnusedBlobs(ociDir, usedBlobs)
 			if err != nil {
-				log.Fatalf("failed to delete unused blobs: %w", err)
+				log.Fatalf("%v", err)
 				return
 			}
 
+			if code := report.exitCode(); code != 0 {
+				log.Errorf("failed to update %d of %d images", report.Failed, len(report.Specs))
+				log.Sync()
+				os.Exit(code)
+			}
+
 			log.Infof("Done")
 		},
 	}
 
-	rootCmd.Flags().StringVar(&ociDir, "cache", "", "path to OCI cache")
-	rootCmd.Flags().StringVar(&imageDir, "lxdimages", "", "path to directory for generated LXD images")
-	rootCmd.Flags().StringVar(&specDir, "specs", "", "path to directory with LXD image specifications")
-	rootCmd.Flags().StringVar(&imageFormat, "imageformat", "squashfs", "format of the generated rootfs'")
-
-	rootCmd.MarkFlagRequired("cache")
-	rootCmd.MarkFlagRequired("lxdimages")
-	rootCmd.MarkFlagRequired("specs")
+	rootCmd.PersistentFlags().StringVar(&ociDir, "cache", "", "path to OCI cache")
+	rootCmd.PersistentFlags().StringVar(&imageDir, "lxdimages", "", "path to directory for generated LXD images")
+	rootCmd.PersistentFlags().StringVar(&specDir, "specs", "", "path to directory with LXD image specifications")
+	rootCmd.PersistentFlags().StringVar(&imageFormat, "imageformat", "squashfs", "format of the generated rootfs'")
+	rootCmd.PersistentFlags().StringVar(&squashfsCompression, "squashfs-compression", "gzip", "compression used for squashfs images")
+	rootCmd.PersistentFlags().IntVar(&keepVersions, "keep-versions", 2, "number of versions to keep per image, including the current one")
+	rootCmd.PersistentFlags().DurationVar(&maxAge, "max-age", 0, "keep older versions until they reach this age")
+	rootCmd.PersistentFlags().BoolVar(&waitForLock, "wait", false, "wait for other instances instead of failing")
+	rootCmd.PersistentFlags().IntVar(&jobs, "jobs", 1, "number of specs to update at the same time")
+	rootCmd.PersistentFlags().IntVar(&fetchJobs, "fetch-jobs", 0, "number of images to fetch at the same time, defaults to --jobs")
+	rootCmd.PersistentFlags().IntVar(&buildJobs, "build-jobs", 0, "number of rootfs' and build steps to generate at the same time, defaults to --jobs")
+	rootCmd.PersistentFlags().BoolVar(&offline, "offline", false, "only use images from the OCI cache")
+	rootCmd.Flags().StringVar(&reportPath, "report", "", "write the result of every spec to this file, or stdout if it's \"-\"")
+	rootCmd.Flags().StringVar(&reportFormat, "report-format", "json", "format of --report: json or yaml")
+	rootCmd.PersistentFlags().StringVar(&busyboxDir, "busybox", "", "path to directory with static busybox binaries per architecture")
+	rootCmd.PersistentFlags().StringVar(&registryAuthPath, "registry-auth", "", "path to yaml file with registry credentials")
+	rootCmd.PersistentFlags().StringVar(&registryConfigPath, "registry-config", "", "path to yaml file with registry mirrors and TLS settings")
+
+	rootCmd.MarkPersistentFlagRequired("cache")
+	rootCmd.MarkPersistentFlagRequired("lxdimages")
+	rootCmd.MarkPersistentFlagRequired("specs")
+
+	rootCmd.AddCommand(newDaemonCommand(&ociDir, &specDir, &imageDir))
+	rootCmd.AddCommand(newOutdatedCommand(&specDir, &imageDir))
 
 	rootCmd.Execute()
 }
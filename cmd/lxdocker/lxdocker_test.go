@@ -0,0 +1,266 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"go.uber.org/zap"
+)
+
+// testLayer builds a layer from entries like `dir/` for directories,
+// `name=contents` for files and `name->target` for symlinks
+func testLayer(t *testing.T, entries ...string) v1.Layer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tarWriter := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry, Typeflag: tar.TypeReg, Mode: 0644}
+		contents := ""
+
+		switch {
+		case strings.HasSuffix(entry, "/"):
+			header.Typeflag = tar.TypeDir
+			header.Mode = 0755
+		case strings.Contains(entry, "->"):
+			parts := strings.SplitN(entry, "->", 2)
+			header.Name = parts[0]
+			header.Typeflag = tar.TypeSymlink
+			header.Linkname = parts[1]
+		case strings.Contains(entry, "="):
+			parts := strings.SplitN(entry, "=", 2)
+			header.Name = parts[0]
+			contents = parts[1]
+		}
+		header.Size = int64(len(contents))
+
+		if err := tarWriter.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tarWriter.Write([]byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data := buf.Bytes()
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return layer
+}
+
+// mergedEntries returns the entries of a merged rootfs in the notation of
+// testLayer, without the `rootfs/` prefix
+func mergedEntries(t *testing.T, data []byte) []string {
+	t.Helper()
+
+	entries := []string{}
+	tarReader := tar.NewReader(bytes.NewReader(data))
+	for {
+		header, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		name := strings.TrimPrefix(header.Name, "rootfs/")
+		switch header.Typeflag {
+		case tar.TypeDir:
+			entries = append(entries, name+"/")
+		case tar.TypeSymlink:
+			entries = append(entries, name+"->"+header.Linkname)
+		default:
+			contents, err := ioutil.ReadAll(tarReader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries = append(entries, name+"="+string(contents))
+		}
+	}
+
+	return entries
+}
+
+func TestWriteLayers(t *testing.T) {
+	tests := []struct {
+		name   string
+		layers [][]string
+		want   []string
+	}{
+		{
+			name: "files of newer layers win",
+			layers: [][]string{
+				{"etc/", "etc/a=old", "etc/b=old"},
+				{"etc/a=new"},
+			},
+			want: []string{"etc/a=new", "etc/", "etc/b=old"},
+		},
+		{
+			name: "whiteout",
+			layers: [][]string{
+				{"etc/", "etc/a=old", "etc/b=old"},
+				{"etc/.wh.a"},
+			},
+			want: []string{"etc/", "etc/b=old"},
+		},
+		{
+			name: "opaque dir",
+			layers: [][]string{
+				{"etc/", "etc/a=old", "etc/sub/", "etc/sub/b=old"},
+				{"etc/", "etc/.wh..wh..opq", "etc/c=new"},
+			},
+			want: []string{"etc/", "etc/c=new"},
+		},
+		{
+			name: "opaque dir without an entry keeps the older one",
+			layers: [][]string{
+				{"etc/", "etc/a=old"},
+				{"etc/.wh..wh..opq", "etc/c=new"},
+			},
+			want: []string{"etc/c=new", "etc/"},
+		},
+		{
+			name: "opaque dir only hides older layers",
+			layers: [][]string{
+				{"etc/", "etc/a=old"},
+				{"etc/", "etc/b=middle"},
+				{"etc/.wh..wh..opq", "etc/c=new"},
+			},
+			want: []string{"etc/c=new", "etc/"},
+		},
+		{
+			name: "opaque dir inside of a removed dir",
+			layers: [][]string{
+				{"etc/", "etc/sub/", "etc/sub/a=old"},
+				{"etc/sub/", "etc/sub/.wh..wh..opq", "etc/sub/b=middle"},
+				{"etc/", "etc/.wh.sub"},
+			},
+			want: []string{"etc/"},
+		},
+		{
+			name: "nested whiteouts",
+			layers: [][]string{
+				{"a/", "a/b/", "a/b/c=old", "a/b/d=old", "a/e=old"},
+				{"a/b/.wh.c"},
+				{"a/.wh.b"},
+			},
+			want: []string{"a/", "a/e=old"},
+		},
+		{
+			name: "recreated dir after a whiteout",
+			layers: [][]string{
+				{"a/", "a/b/", "a/b/c=old"},
+				{"a/.wh.b"},
+				{"a/b/", "a/b/.wh.missing", "a/b/new=new"},
+			},
+			want: []string{"a/b/", "a/b/new=new", "a/"},
+		},
+		{
+			name: "file replaces dir",
+			layers: [][]string{
+				{"x/", "x/y=old", "x/z/", "x/z/w=old"},
+				{"x=file"},
+			},
+			want: []string{"x=file"},
+		},
+		{
+			name: "symlink replaces dir",
+			layers: [][]string{
+				{"x/", "x/y=old"},
+				{"x->/tmp"},
+			},
+			want: []string{"x->/tmp"},
+		},
+		{
+			name: "dir replaces file",
+			layers: [][]string{
+				{"x=file"},
+				{".wh.x", "x/", "x/y=new"},
+			},
+			want: []string{"x/", "x/y=new"},
+		},
+		{
+			name: "dir replaces file without a whiteout",
+			layers: [][]string{
+				{"x=file"},
+				{"x/", "x/y=new"},
+			},
+			want: []string{"x/", "x/y=new"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			layers := []v1.Layer{}
+			for _, entries := range test.layers {
+				layers = append(layers, testLayer(t, entries...))
+			}
+
+			img, err := mutate.AppendLayers(empty.Image, layers...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			imgLayers, err := img.Layers()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var buf bytes.Buffer
+			tarWriter := tar.NewWriter(&buf)
+			err = writeLayers(zap.NewNop().Sugar(), tarWriter, map[string]bool{}, imgLayers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tarWriter.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			got := mergedEntries(t, buf.Bytes())
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestWriteLayersKeepsOlderHeaderOfOpaqueDir(t *testing.T) {
+	layers := []v1.Layer{
+		testLayer(t, "etc/"),
+		testLayer(t, "etc/.wh..wh..opq"),
+	}
+
+	var buf bytes.Buffer
+	tarWriter := tar.NewWriter(&buf)
+	err := writeLayers(zap.NewNop().Sugar(), tarWriter, map[string]bool{}, layers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tarWriter.Close()
+
+	header, err := tar.NewReader(&buf).Next()
+	if err != nil {
+		t.Fatalf("the opaque dir is missing: %v", err)
+	}
+	if header.Name != "rootfs/etc" || header.Mode != 0755 {
+		t.Errorf("got `%s` with mode %o, want `rootfs/etc` with mode 755", header.Name, header.Mode)
+	}
+}
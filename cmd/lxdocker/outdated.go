@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/spf13/cobra"
+	"pkg/common"
+)
+
+// outdatedImage is an image with a newer digest in the registry
+type outdatedImage struct {
+	name     string
+	platform string
+	current  string
+	latest   string
+}
+
+// checkOutdated resolves the tag of a spec against the registry with a single
+// HEAD request. Pinned specs are compared with the digest the tag points to,
+// the others with the digest it pointed to when we generated the images last
+// time. For multi-platform images, that's the digest of the index.
+func checkOutdated(imageDir string, imageName string, spec ImageSpec) ([]outdatedImage, error) {
+	var err error
+	if spec.TagPolicy != nil {
+		spec.tag, err = resolveTag(log, spec)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ref, err := spec.reference()
+	if err != nil {
+		return nil, err
+	}
+
+	var desc *v1.Descriptor
+	err = remoteDo(log, ref, spec, func(ref name.Reference, opts ...remote.Option) error {
+		var err error
+		desc, err = remote.Head(ref, opts...)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve `%s`: %w", ref.Name(), err)
+	}
+
+	if spec.Digest != "" {
+		if desc.Digest.String() == spec.Digest {
+			return nil, nil
+		}
+
+		return []outdatedImage{{name: imageName, platform: "-", current: spec.Digest, latest: desc.Digest.String()}}, nil
+	}
+
+	platforms, _ := spec.parsePlatforms()
+
+	result := []outdatedImage{}
+	for _, platform := range platforms {
+		current := "-"
+		metadataFilepath := filepath.Join(imageDir, fmt.Sprintf("%s.meta", spec.metadataStem(imageName, platform)))
+		if rootMeta, err := common.ReadRootfsMetaData(metadataFilepath); err == nil {
+			upToDate := rootMeta.RemoteDigest == desc.Digest
+			currentDigest := rootMeta.RemoteDigest
+
+			// metadata of older lxdocker versions only knows the digest of
+			// the image of the platform
+			if rootMeta.RemoteDigest == (v1.Hash{}) {
+				latest, err := platformDigest(ref, spec, platform)
+				if err != nil {
+					return nil, err
+				}
+
+				upToDate = rootMeta.OciImageDigest == latest
+				currentDigest = rootMeta.OciImageDigest
+			}
+
+			if upToDate && rootMeta.Tag == spec.tag {
+				continue
+			}
+
+			current = taggedDigest(rootMeta.Tag, currentDigest.String())
+		}
+
+		result = append(result, outdatedImage{name: imageName, platform: platform.String(), current: current, latest: taggedDigest(spec.tag, desc.Digest.String())})
+	}
+
+	return result, nil
+}
+
+// platformDigest returns the digest of the image of `platform` in the registry
+func platformDigest(ref name.Reference, spec ImageSpec, platform v1.Platform) (v1.Hash, error) {
+	var rmt *remote.Descriptor
+	err := remoteDo(log, ref, spec, func(ref name.Reference, opts ...remote.Option) error {
+		var err error
+		rmt, err = remote.Get(ref, append(opts, remote.WithPlatform(platform))...)
+		return err
+	})
+	if err != nil {
+		return v1.Hash{}, fmt.Errorf("failed to resolve `%s` `%s`: %w", ref.Name(), platform.String(), err)
+	}
+
+	img, err := rmt.Image()
+	if err != nil {
+		return v1.Hash{}, fmt.Errorf("failed to get remote image: %w", err)
+	}
+
+	latest, err := img.Digest()
+	if err != nil {
+		return v1.Hash{}, fmt.Errorf("failed to hash oci: %w", err)
+	}
+
+	return latest, nil
+}
+
+// taggedDigest prefixes the digest with the tag selected by a tag policy
+func taggedDigest(tag string, digest string) string {
+	if tag == "" {
+		return digest
+	}
+
+	return fmt.Sprintf("%s@%s", tag, digest)
+}
+
+func newOutdatedCommand(specDir *string, imageDir *string) *cobra.Command {
+	return &cobra.Command{
+		Use:   "outdated",
+		Short: "list images with newer digests in the registry without converting anything",
+		Run: func(cmd *cobra.Command, args []string) {
+			if offline {
+				log.Fatalf("outdated needs access to the registries")
+				return
+			}
+
+			specPaths, err := listSpecs(*specDir)
+			if err != nil {
+				log.Fatalf("%v", err)
+				return
+			}
+
+			writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(writer, "NAME\tPLATFORM\tCURRENT\tLATEST")
+
+			failed := false
+			for _, specPath := range specPaths {
+				imageName := specName(specPath)
+
+				spec, _, err := readSpec(specPath)
+				if err != nil {
+					log.Errorf("failed to check `%v`: %v", imageName, err)
+					failed = true
+					continue
+				}
+
+				outdated, err := checkOutdated(*imageDir, imageName, spec)
+				if err != nil {
+					log.Errorf("failed to check `%v`: %v", imageName, err)
+					failed = true
+					continue
+				}
+
+				for _, image := range outdated {
+					fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n", image.name, image.platform, image.current, image.latest)
+				}
+			}
+
+			writer.Flush()
+
+			if failed {
+				os.Exit(1)
+			}
+		},
+	}
+}
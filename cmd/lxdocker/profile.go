@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	lxdapi "github.com/lxc/lxd/shared/api"
+	"gopkg.in/yaml.v3"
+)
+
+// default host directory for volumes that weren't remapped in the spec
+const volumeBaseDir = "/var/lib/lxdocker/volumes"
+
+// normalizePort adds the default protocol to ports like `80`
+func normalizePort(port string) string {
+	if !strings.Contains(port, "/") {
+		return port + "/tcp"
+	}
+
+	return port
+}
+
+// deviceName turns `/var/lib/data` into `var-lib-data`
+func deviceName(s string) string {
+	return strings.Trim(strings.NewReplacer("/", "-", ".", "-", ":", "-").Replace(s), "-")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// generateProfile returns an LXD profile that makes the ports and volumes
+// declared in the OCI image available
+func generateProfile(name string, config *v1.Config, spec ImageSpec) (*lxdapi.ProfilePut, error) {
+	profile := &lxdapi.ProfilePut{
+		Config:      map[string]string{},
+		Description: fmt.Sprintf("devices for lxdocker image %s", name),
+		Devices:     map[string]map[string]string{},
+	}
+
+	ports := map[string]string{}
+	for port := range config.ExposedPorts {
+		ports[normalizePort(port)] = ""
+	}
+
+	hostPorts := map[string]string{}
+	for port, hostPort := range spec.Ports {
+		port = normalizePort(port)
+		if _, ok := ports[port]; !ok {
+			return nil, fmt.Errorf("port `%s` isn't exposed by the image", port)
+		}
+
+		hostPorts[port] = hostPort
+	}
+
+	for _, port := range sortedKeys(ports) {
+		containerPort, protocol, _ := strings.Cut(port, "/")
+
+		listen := containerPort
+		if hostPort, ok := hostPorts[port]; ok {
+			// an empty host port means the port shouldn't be exposed
+			if hostPort == "" {
+				continue
+			}
+
+			listen = hostPort
+		}
+		if !strings.Contains(listen, ":") {
+			listen = "0.0.0.0:" + listen
+		}
+
+		profile.Devices[fmt.Sprintf("port-%s-%s", protocol, containerPort)] = map[string]string{
+			"type":    "proxy",
+			"listen":  fmt.Sprintf("%s:%s", protocol, listen),
+			"connect": fmt.Sprintf("%s:127.0.0.1:%s", protocol, containerPort),
+		}
+	}
+
+	for volume := range spec.Volumes {
+		if _, ok := config.Volumes[volume]; !ok {
+			return nil, fmt.Errorf("volume `%s` isn't declared by the image", volume)
+		}
+	}
+
+	for _, volume := range sortedKeys(config.Volumes) {
+		source, ok := spec.Volumes[volume]
+		if !ok {
+			source = filepath.Join(volumeBaseDir, name, volume)
+		}
+
+		profile.Devices[fmt.Sprintf("volume-%s", deviceName(volume))] = map[string]string{
+			"type":   "disk",
+			"path":   volume,
+			"source": source,
+		}
+	}
+
+	return profile, nil
+}
+
+// writeProfile writes the LXD profile of an image to `<stem>.profile`
+func writeProfile(imageDir string, stem string, name string, config *v1.Config, spec ImageSpec) error {
+	profile, err := generateProfile(name, config, spec)
+	if err != nil {
+		return fmt.Errorf("failed to generate profile: %w", err)
+	}
+
+	profileFilename := fmt.Sprintf("%s.profile", stem)
+
+	file, err := os.CreateTemp(imageDir, profileFilename)
+	if err != nil {
+		return fmt.Errorf("failed to open temp profile file: %w", err)
+	}
+
+	err = yaml.NewEncoder(file).Encode(profile)
+	file.Close()
+	if err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("failed to encode profile: %w", err)
+	}
+
+	err = os.Rename(file.Name(), filepath.Join(imageDir, profileFilename))
+	if err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("failed to rename profile: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// RegistryEndpoint is a registry or a mirror of one
+type RegistryEndpoint struct {
+	// `host[:port][/path]` of a mirror. Repositories are looked up below the
+	// path.
+	Location string
+	// use HTTP instead of HTTPS
+	PlainHTTP bool `yaml:"plain_http"`
+	// don't verify the TLS certificate
+	SkipTLSVerify bool `yaml:"skip_tls_verify"`
+	// PEM file with additional CA certificates
+	CA string `yaml:"ca"`
+
+	transport http.RoundTripper
+}
+
+type RegistryConfig struct {
+	// how to connect to the registry itself
+	RegistryEndpoint `yaml:",inline"`
+	// tried in order before the registry itself
+	Mirrors []RegistryEndpoint
+	// fail instead of falling back to the registry itself
+	MirrorsOnly bool `yaml:"mirrors_only"`
+}
+
+var registryConfigs = map[string]*RegistryConfig{}
+
+func (endpoint *RegistryEndpoint) init() error {
+	if endpoint.CA == "" && !endpoint.SkipTLSVerify {
+		endpoint.transport = remote.DefaultTransport
+		return nil
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: endpoint.SkipTLSVerify,
+	}
+
+	if endpoint.CA != "" {
+		pem, err := ioutil.ReadFile(endpoint.CA)
+		if err != nil {
+			return fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates in `%s`", endpoint.CA)
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	transport := remote.DefaultTransport.Clone()
+	transport.TLSClientConfig = tlsConfig
+	endpoint.transport = transport
+
+	return nil
+}
+
+func readRegistryConfigs(path string) (map[string]*RegistryConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read `%s`: %w", path, err)
+	}
+
+	configs := map[string]*RegistryConfig{}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	err = decoder.Decode(&configs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse `%s`: %w", path, err)
+	}
+
+	result := map[string]*RegistryConfig{}
+	for registryName, config := range configs {
+		// normalize the registry so `docker.io` matches `index.docker.io`
+		registry, err := name.NewRegistry(registryName)
+		if err != nil {
+			return nil, fmt.Errorf("invalid registry `%s`: %w", registryName, err)
+		}
+
+		if config.Location != "" {
+			return nil, fmt.Errorf("registry `%s` can't have a location", registryName)
+		}
+		if config.MirrorsOnly && len(config.Mirrors) == 0 {
+			return nil, fmt.Errorf("registry `%s` uses mirrors_only without mirrors", registryName)
+		}
+
+		err = config.init()
+		if err != nil {
+			return nil, fmt.Errorf("registry `%s`: %w", registryName, err)
+		}
+
+		for i := range config.Mirrors {
+			mirror := &config.Mirrors[i]
+			if mirror.Location == "" {
+				return nil, fmt.Errorf("mirror of `%s` without location", registryName)
+			}
+
+			err = mirror.init()
+			if err != nil {
+				return nil, fmt.Errorf("mirror `%s`: %w", mirror.Location, err)
+			}
+		}
+
+		result[registry.RegistryStr()] = config
+	}
+
+	return result, nil
+}
+
+// reference returns `ref` on this endpoint
+func (endpoint *RegistryEndpoint) reference(ref name.Reference) (name.Reference, error) {
+	opts := []name.Option{}
+	if endpoint.PlainHTTP {
+		opts = append(opts, name.Insecure)
+	}
+
+	repoName := ref.Context().Name()
+	if endpoint.Location != "" {
+		repoName = fmt.Sprintf("%s/%s", strings.TrimSuffix(endpoint.Location, "/"), ref.Context().RepositoryStr())
+	}
+
+	repo, err := name.NewRepository(repoName, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mirror reference: %w", err)
+	}
+
+	switch ref := ref.(type) {
+	case name.Digest:
+		return repo.Digest(ref.DigestStr()), nil
+	case name.Tag:
+		return repo.Tag(ref.TagStr()), nil
+	default:
+		return nil, fmt.Errorf("BUG: unsupported reference `%s`", ref.Name())
+	}
+}
+
+// remoteDo calls `fn` with the options for every mirror of the registry of
+// `ref`, and the registry itself, until one of them succeeds.
+func remoteDo(log *zap.SugaredLogger, ref name.Reference, spec ImageSpec, fn func(ref name.Reference, opts ...remote.Option) error) error {
+	endpoints := []*RegistryEndpoint{{transport: remote.DefaultTransport}}
+
+	if config, ok := registryConfigs[ref.Context().RegistryStr()]; ok {
+		endpoints = []*RegistryEndpoint{}
+		for i := range config.Mirrors {
+			endpoints = append(endpoints, &config.Mirrors[i])
+		}
+		if !config.MirrorsOnly {
+			endpoints = append(endpoints, &config.RegistryEndpoint)
+		}
+	}
+
+	var lastErr error
+	errs := []string{}
+	for _, endpoint := range endpoints {
+		endpointRef, err := endpoint.reference(ref)
+		if err != nil {
+			return err
+		}
+
+		// credentials from the spec are only for the registry itself
+		authSpec := spec
+		if endpoint.Location != "" {
+			authSpec = ImageSpec{}
+		}
+
+		auth, err := getAuthenticator(endpointRef, authSpec)
+		if err != nil {
+			return fmt.Errorf("failed to get registry credentials: %w", err)
+		}
+
+		err = fn(endpointRef, remote.WithAuth(auth), remote.WithTransport(endpoint.transport))
+		if err == nil {
+			return nil
+		}
+
+		if len(endpoints) > 1 {
+			log.Warnf("`%v` failed: %v", endpointRef.Context().RegistryStr(), err)
+		}
+		errs = append(errs, err.Error())
+		lastErr = err
+	}
+
+	if len(errs) == 1 {
+		return lastErr
+	}
+
+	return fmt.Errorf("all mirrors failed: %s", strings.Join(errs, "; "))
+}
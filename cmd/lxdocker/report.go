@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// exit codes if updating some or all specs failed. Other errors exit with 1.
+const exitPartialFailure = 2
+const exitTotalFailure = 3
+
+type reportStatus string
+
+const (
+	reportUnchanged reportStatus = "unchanged"
+	reportRebuilt   reportStatus = "rebuilt"
+	reportFailed    reportStatus = "failed"
+	reportSkipped   reportStatus = "skipped"
+)
+
+// platformReport is the result of updating a spec for a single platform
+type platformReport struct {
+	Platform        string       `json:"platform" yaml:"platform"`
+	Status          reportStatus `json:"status" yaml:"status"`
+	OldOciDigest    string       `json:"old_oci_digest,omitempty" yaml:"old_oci_digest,omitempty"`
+	NewOciDigest    string       `json:"new_oci_digest,omitempty" yaml:"new_oci_digest,omitempty"`
+	OldRootfsDigest string       `json:"old_rootfs_digest,omitempty" yaml:"old_rootfs_digest,omitempty"`
+	NewRootfsDigest string       `json:"new_rootfs_digest,omitempty" yaml:"new_rootfs_digest,omitempty"`
+	Error           string       `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// specReport is the result of updating a spec
+type specReport struct {
+	Name      string           `json:"name" yaml:"name"`
+	Status    reportStatus     `json:"status" yaml:"status"`
+	Tag       string           `json:"tag,omitempty" yaml:"tag,omitempty"`
+	Duration  float64          `json:"duration_seconds" yaml:"duration_seconds"`
+	Error     string           `json:"error,omitempty" yaml:"error,omitempty"`
+	Platforms []platformReport `json:"platforms,omitempty" yaml:"platforms,omitempty"`
+}
+
+// runReport is what `--report` writes
+type runReport struct {
+	Started  time.Time    `json:"started" yaml:"started"`
+	Duration float64      `json:"duration_seconds" yaml:"duration_seconds"`
+	Failed   int          `json:"failed" yaml:"failed"`
+	Error    string       `json:"error,omitempty" yaml:"error,omitempty"`
+	Specs    []specReport `json:"specs" yaml:"specs"`
+}
+
+// finish sets the status of the spec once all platforms are done
+func (report *specReport) finish(skipped bool, err error, duration time.Duration) {
+	report.Duration = duration.Seconds()
+
+	switch {
+	case skipped:
+		report.Status = reportSkipped
+	case err != nil:
+		report.Status = reportFailed
+		report.Error = err.Error()
+	default:
+		report.Status = reportUnchanged
+		for _, platform := range report.Platforms {
+			if platform.Status == reportRebuilt {
+				report.Status = reportRebuilt
+			}
+		}
+	}
+}
+
+func newRunReport(started time.Time, specs []specReport, err error) *runReport {
+	report := &runReport{
+		Started:  started.UTC(),
+		Duration: time.Since(started).Seconds(),
+		Specs:    specs,
+	}
+	if report.Specs == nil {
+		report.Specs = []specReport{}
+	}
+	if err != nil {
+		report.Error = err.Error()
+	}
+
+	for _, spec := range specs {
+		if spec.Status == reportFailed {
+			report.Failed++
+		}
+	}
+
+	return report
+}
+
+// exitCode returns 0 if nothing failed, or which part of the update failed
+func (report *runReport) exitCode() int {
+	if report.Failed == 0 {
+		return 0
+	}
+
+	for _, spec := range report.Specs {
+		if spec.Status != reportFailed && spec.Status != reportSkipped {
+			return exitPartialFailure
+		}
+	}
+
+	return exitTotalFailure
+}
+
+// write writes the report to `path`, or stdout if it's `-`
+func (report *runReport) write(path string, format string) error {
+	var data []byte
+	var err error
+
+	switch format {
+	case "json":
+		data, err = json.MarshalIndent(report, "", "  ")
+		data = append(data, '\n')
+	case "yaml":
+		data, err = yaml.Marshal(report)
+	default:
+		return fmt.Errorf("unsupported report format `%s`", format)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to encode report: %w", err)
+	}
+
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+
+	// don't let monitoring read a partial report
+	tmpPath := path + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return fmt.Errorf("failed to rename report: %w", err)
+	}
+
+	return nil
+}
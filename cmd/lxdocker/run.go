@@ -0,0 +1,907 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"go.uber.org/zap"
+	"pkg/common"
+)
+
+// directory in the cache where the layers generated by `run` are stored
+const runLayerDir = "run-layers"
+
+// prefix of the temporary directories the rootfs gets extracted to
+const runTmpPrefix = "run-tmp-"
+
+// argument which makes lxdocker run build steps inside of its sandbox
+const sandboxArg = "__lxdocker-sandbox"
+
+// these are mounted by the sandbox, so changes aren't part of the layer
+var sandboxMounts = map[string]bool{
+	"proc": true,
+	"sys":  true,
+	"dev":  true,
+}
+
+// runCacheKey identifies the result of running the build steps of a spec on
+// an image
+func runCacheKey(img v1.Image, spec ImageSpec, config *v1.Config) (string, error) {
+	digest, err := img.Digest()
+	if err != nil {
+		return "", fmt.Errorf("failed to hash oci: %w", err)
+	}
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\x00%s\x00%v\x00", digest.String(), config.WorkingDir, spec.RunNetwork)
+	for _, keyval := range config.Env {
+		fmt.Fprintf(hash, "env\x00%s\x00", keyval)
+	}
+	for _, step := range spec.Run {
+		fmt.Fprintf(hash, "run\x00%s\x00", step)
+	}
+
+	return hashToV1(hash.Sum(nil)).Hex, nil
+}
+
+// applyRunSteps runs the `run` steps of the spec on the rootfs of `img` and
+// returns the image with the changes as additional layer, and the key of the
+// layer in the cache.
+func applyRunSteps(log *zap.SugaredLogger, output io.Writer, ociDir string, img v1.Image, name string, spec ImageSpec) (v1.Image, string, error) {
+	configFile, err := img.ConfigFile()
+	if err != nil {
+		return nil, "", fmt.Errorf("retrieving image config file: %w", err)
+	}
+	config := applySpecConfig(&configFile.Config, spec)
+
+	key, err := runCacheKey(img, spec, config)
+	if err != nil {
+		return nil, "", err
+	}
+
+	layerPath := filepath.Join(ociDir, runLayerDir, fmt.Sprintf("%s.tar", key))
+	if _, err := os.Stat(layerPath); err == nil {
+		log.Infof("use cached result of build steps for `%v`", name)
+	} else {
+		err = generateRunLayer(log, output, ociDir, img, layerPath, spec, config)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	layer, err := tarball.LayerFromFile(layerPath, tarball.WithCompressionLevel(gzip.BestSpeed))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to open layer of build steps: %w", err)
+	}
+
+	img, err = mutate.AppendLayers(img, layer)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to append layer of build steps: %w", err)
+	}
+
+	return img, key, nil
+}
+
+func generateRunLayer(log *zap.SugaredLogger, output io.Writer, ociDir string, img v1.Image, layerPath string, spec ImageSpec, config *v1.Config) error {
+	ids, err := newSandboxIDs()
+	if err != nil {
+		return err
+	}
+
+	tmpDir, err := os.MkdirTemp(ociDir, runTmpPrefix)
+	if err != nil {
+		return fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	defer removeTree(log, tmpDir)
+
+	// root of the sandbox isn't root on the host, but has to reach the rootfs
+	err = os.Chmod(tmpDir, 0711)
+	if err != nil {
+		return fmt.Errorf("failed to chmod temp dir: %w", err)
+	}
+
+	if ids.uid != os.Getuid() {
+		err = checkSearchable(ociDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	rootfs := filepath.Join(tmpDir, "rootfs")
+
+	log.Infof("extract rootfs to %v", rootfs)
+	owners, err := extractImage(log, img, rootfs, ids)
+	if err != nil {
+		return fmt.Errorf("failed to extract rootfs: %w", err)
+	}
+
+	// the sandbox mounts the host's resolv.conf over this file
+	resolvConf := filepath.Join(rootfs, "etc/resolv.conf")
+	if spec.RunNetwork {
+		if _, err := os.Lstat(resolvConf); errors.Is(err, fs.ErrNotExist) {
+			if err := os.MkdirAll(filepath.Dir(resolvConf), 0755); err != nil {
+				return fmt.Errorf("failed to create /etc: %w", err)
+			}
+			if err := os.WriteFile(resolvConf, nil, 0644); err != nil {
+				return fmt.Errorf("failed to create /etc/resolv.conf: %w", err)
+			}
+		}
+	}
+
+	before, err := snapshotTree(rootfs)
+	if err != nil {
+		return fmt.Errorf("failed to scan rootfs: %w", err)
+	}
+
+	err = runSandbox(log, output, rootfs, spec, config, ids)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(layerPath), os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("failed to create layer dir: %w", err)
+	}
+
+	// another spec might generate the same layer at the same time
+	layerTemp := filepath.Join(tmpDir, "layer.tar")
+	err = writeDiffLayer(rootfs, before, owners, layerTemp, ids)
+	if err != nil {
+		return fmt.Errorf("failed to write layer: %w", err)
+	}
+
+	err = os.Rename(layerTemp, layerPath)
+	if err != nil {
+		return fmt.Errorf("failed to rename layer: %w", err)
+	}
+
+	return nil
+}
+
+// removeTree deletes `path` even if it contains read-only directories
+func removeTree(log *zap.SugaredLogger, path string) {
+	filepath.WalkDir(path, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && entry.IsDir() {
+			os.Chmod(path, 0700)
+		}
+		return nil
+	})
+
+	err := os.RemoveAll(path)
+	if err != nil {
+		log.Errorf("failed to delete `%v`: %v", path, err)
+	}
+}
+
+// securePath returns the path of `name` inside of `root`. It fails if a parent
+// is a symlink, so the image can't make us write outside of `root`.
+func securePath(root string, name string) (string, error) {
+	name = filepath.Clean("/" + name)
+	if name == "/" {
+		return root, nil
+	}
+
+	current := root
+	parts := strings.Split(strings.TrimPrefix(filepath.Dir(name), "/"), "/")
+	for _, part := range parts {
+		if part == "" {
+			continue
+		}
+
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				break
+			}
+			return "", err
+		}
+		if !info.IsDir() {
+			return "", fmt.Errorf("parent of `%s` isn't a directory", name)
+		}
+	}
+
+	return filepath.Join(root, name), nil
+}
+
+// fileOwner is the owner of a file in the OCI image
+type fileOwner struct {
+	uid int
+	gid int
+}
+
+// extractImage writes the merged layers of `img` to `root`. Ownership is
+// only kept if we're root, shifted to the ids of the sandbox. Otherwise
+// everything belongs to us, and the owners from the image are returned
+// instead.
+func extractImage(log *zap.SugaredLogger, img v1.Image, root string, ids sandboxIDs) (map[string]fileOwner, error) {
+	reader := mutate.Extract(img)
+	defer reader.Close()
+
+	isRoot := os.Getuid() == 0
+	owners := map[string]fileOwner{}
+	// directories might be read-only, so their mode is applied at the end
+	dirModes := map[string]os.FileMode{}
+
+	err := os.MkdirAll(root, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading tar: %w", err)
+		}
+
+		path, err := securePath(root, header.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return nil, err
+		}
+
+		mode := os.FileMode(header.Mode).Perm()
+		if header.Mode&04000 != 0 {
+			mode |= os.ModeSetuid
+		}
+		if header.Mode&02000 != 0 {
+			mode |= os.ModeSetgid
+		}
+		if header.Mode&01000 != 0 {
+			mode |= os.ModeSticky
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.Mkdir(path, 0755)
+			if errors.Is(err, fs.ErrExist) {
+				err = nil
+			}
+			dirModes[path] = mode
+		case tar.TypeReg, tar.TypeRegA:
+			var file *os.File
+			file, err = os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+			if err != nil {
+				return nil, err
+			}
+			_, err = io.Copy(file, tarReader)
+			file.Close()
+		case tar.TypeSymlink:
+			err = os.Symlink(header.Linkname, path)
+		case tar.TypeLink:
+			var target string
+			target, err = securePath(root, header.Linkname)
+			if err != nil {
+				return nil, err
+			}
+			err = os.Link(target, path)
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			devMode := uint32(syscall.S_IFIFO)
+			if header.Typeflag == tar.TypeChar {
+				devMode = syscall.S_IFCHR
+			} else if header.Typeflag == tar.TypeBlock {
+				devMode = syscall.S_IFBLK
+			}
+
+			dev := (header.Devminor & 0xff) | (header.Devmajor << 8) | ((header.Devminor &^ 0xff) << 12)
+			err = syscall.Mknod(path, devMode|uint32(mode.Perm()), int(dev))
+			// unprivileged users can't create devices, but the build steps
+			// don't need them anyway
+			if errors.Is(err, fs.ErrPermission) {
+				log.Debugf("skip device `%v`: %v", header.Name, err)
+				continue
+			}
+		default:
+			log.Debugf("skip `%v` with unsupported type %q", header.Name, header.Typeflag)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to extract `%s`: %w", header.Name, err)
+		}
+
+		if isRoot {
+			uid, gid, err := ids.hostIDs(header.Uid, header.Gid)
+			if err != nil {
+				return nil, fmt.Errorf("failed to chown `%s`: %w", header.Name, err)
+			}
+
+			err = os.Lchown(path, uid, gid)
+			if err != nil {
+				return nil, fmt.Errorf("failed to chown `%s`: %w", header.Name, err)
+			}
+		} else {
+			name := strings.TrimPrefix(filepath.Clean("/"+header.Name), "/")
+			owners[name] = fileOwner{uid: header.Uid, gid: header.Gid}
+		}
+
+		if header.Typeflag != tar.TypeSymlink && header.Typeflag != tar.TypeDir && header.Typeflag != tar.TypeLink {
+			err = os.Chmod(path, mode)
+			if err != nil {
+				return nil, fmt.Errorf("failed to chmod `%s`: %w", header.Name, err)
+			}
+		}
+	}
+
+	for path, mode := range dirModes {
+		err = os.Chmod(path, mode)
+		if err != nil {
+			return nil, fmt.Errorf("failed to chmod `%s`: %w", path, err)
+		}
+	}
+
+	if !isRoot {
+		return owners, nil
+	}
+
+	// the root and parents without an entry in the image belong to us, but
+	// have to belong to root of the sandbox
+	return nil, filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		stat := info.Sys().(*syscall.Stat_t)
+		if int(stat.Uid) == os.Getuid() && int(stat.Gid) == os.Getgid() {
+			return os.Lchown(path, ids.uid, ids.gid)
+		}
+
+		return nil
+	})
+}
+
+type fileState struct {
+	ino   uint64
+	ctime syscall.Timespec
+	mode  uint32
+	size  int64
+}
+
+// snapshotTree records the state of every file in `root`, so we can find the
+// changes later. The ctime changes whenever the file or its inode is modified.
+func snapshotTree(root string) (map[string]fileState, error) {
+	files := map[string]fileState{}
+
+	err := walkRootfs(root, func(name string, path string, info fs.FileInfo) error {
+		stat := info.Sys().(*syscall.Stat_t)
+		files[name] = fileState{
+			ino:   stat.Ino,
+			ctime: stat.Ctim,
+			mode:  stat.Mode,
+			size:  stat.Size,
+		}
+		return nil
+	})
+
+	return files, err
+}
+
+// walkRootfs calls `fn` for everything in `root` except for the directories
+// the sandbox mounts over
+func walkRootfs(root string, fn func(name string, path string, info fs.FileInfo) error) error {
+	return filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		name, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			return nil
+		}
+		if sandboxMounts[name] {
+			return filepath.SkipDir
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		return fn(name, path, info)
+	})
+}
+
+// writeDiffLayer writes everything that changed in `root` since `before` was
+// taken to an OCI layer at `layerPath`. Files from the image keep their owner
+// from `owners` if there's one.
+func writeDiffLayer(root string, before map[string]fileState, owners map[string]fileOwner, layerPath string, ids sandboxIDs) error {
+	file, err := os.Create(layerPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	tarWriter := tar.NewWriter(file)
+
+	after := map[string]bool{}
+	links := map[uint64]string{}
+
+	err = walkRootfs(root, func(name string, path string, info fs.FileInfo) error {
+		after[name] = true
+
+		stat := info.Sys().(*syscall.Stat_t)
+		state := fileState{
+			ino:   stat.Ino,
+			ctime: stat.Ctim,
+			mode:  stat.Mode,
+			size:  stat.Size,
+		}
+		if old, ok := before[name]; ok && old == state {
+			return nil
+		}
+
+		link := ""
+		if info.Mode()&fs.ModeSymlink != 0 {
+			link, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		header.Format = tar.FormatPAX
+		header.Uname = ""
+		header.Gname = ""
+
+		header.Uid, header.Gid = ids.sandboxIDs(header.Uid, header.Gid)
+		if owner, ok := owners[name]; ok {
+			if _, existed := before[name]; existed {
+				header.Uid, header.Gid = owner.uid, owner.gid
+			}
+		}
+
+		if info.Mode().IsRegular() && stat.Nlink > 1 {
+			if target, ok := links[stat.Ino]; ok {
+				header.Typeflag = tar.TypeLink
+				header.Linkname = target
+				header.Size = 0
+			} else {
+				links[stat.Ino] = name
+			}
+		}
+
+		err = tarWriter.WriteHeader(header)
+		if err != nil {
+			return err
+		}
+
+		if header.Typeflag == tar.TypeReg && header.Size > 0 {
+			input, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer input.Close()
+
+			_, err = io.CopyN(tarWriter, input, header.Size)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// whiteouts for deleted files. Children of deleted directories are
+	// deleted implicitly.
+	deleted := []string{}
+	for name := range before {
+		if !after[name] {
+			deleted = append(deleted, name)
+		}
+	}
+	sort.Strings(deleted)
+
+	for _, name := range deleted {
+		if !after[filepath.Dir(name)] && filepath.Dir(name) != "." {
+			continue
+		}
+
+		header := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     filepath.Join(filepath.Dir(name), whiteoutPrefix+filepath.Base(name)),
+			Mode:     0644,
+			Format:   tar.FormatPAX,
+		}
+		err = tarWriter.WriteHeader(header)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tarWriter.Close()
+	if err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+// sandboxIDs maps the uids and gids of the sandbox to the host. ID 0 inside of
+// it is `uid` and `gid` outside of it.
+type sandboxIDs struct {
+	uid  int
+	gid  int
+	size int
+}
+
+// images usually need at least the ids up to `nobody`
+const minSubordinateIDs = 65536
+
+// readSubordinateIDs returns the first range in /etc/subuid or /etc/subgid
+// for `user` that's large enough
+func readSubordinateIDs(path string, user string, id int) (int, int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Split(strings.TrimSpace(line), ":")
+		if len(fields) != 3 || (fields[0] != user && fields[0] != strconv.Itoa(id)) {
+			continue
+		}
+
+		start, err := strconv.Atoi(fields[1])
+		if err != nil || start <= 0 {
+			continue
+		}
+		count, err := strconv.Atoi(fields[2])
+		if err != nil || count < minSubordinateIDs {
+			continue
+		}
+
+		return start, count, nil
+	}
+
+	return 0, 0, fmt.Errorf("no range of at least %d ids for `%s` in `%s`", minSubordinateIDs, user, path)
+}
+
+// newSandboxIDs returns the ids used for the sandbox. As root, they're an
+// unprivileged range of subordinate ids. Otherwise we can only map ourselves.
+func newSandboxIDs() (sandboxIDs, error) {
+	if os.Getuid() != 0 {
+		return sandboxIDs{uid: os.Getuid(), gid: os.Getgid(), size: 1}, nil
+	}
+
+	uid, uidCount, err := readSubordinateIDs("/etc/subuid", "root", 0)
+	if err != nil {
+		return sandboxIDs{}, fmt.Errorf("build steps need subordinate uids for root: %w", err)
+	}
+	gid, gidCount, err := readSubordinateIDs("/etc/subgid", "root", 0)
+	if err != nil {
+		return sandboxIDs{}, fmt.Errorf("build steps need subordinate gids for root: %w", err)
+	}
+
+	size := uidCount
+	if gidCount < size {
+		size = gidCount
+	}
+
+	return sandboxIDs{uid: uid, gid: gid, size: size}, nil
+}
+
+// checkSearchable fails if the subordinate ids can't reach `dir` because
+// one of its parents isn't searchable by others
+func checkSearchable(dir string) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+
+	for {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if info.Mode().Perm()&0001 == 0 {
+			return fmt.Errorf("build steps need `%s` to be searchable by others, since they run with subordinate ids", dir)
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil
+		}
+		dir = parent
+	}
+}
+
+// hostIDs returns the ids on the host of ids inside of the sandbox
+func (ids sandboxIDs) hostIDs(uid int, gid int) (int, int, error) {
+	if uid < 0 || uid >= ids.size || gid < 0 || gid >= ids.size {
+		return 0, 0, fmt.Errorf("`%d:%d` is outside of the %d subordinate ids", uid, gid, ids.size)
+	}
+
+	return ids.uid + uid, ids.gid + gid, nil
+}
+
+// sandboxIDs returns the ids inside of the sandbox of ids on the host. Ids
+// which aren't mapped are returned unchanged.
+func (ids sandboxIDs) sandboxIDs(uid int, gid int) (int, int) {
+	if uid >= ids.uid && uid < ids.uid+ids.size {
+		uid -= ids.uid
+	}
+	if gid >= ids.gid && gid < ids.gid+ids.size {
+		gid -= ids.gid
+	}
+
+	return uid, gid
+}
+
+// runSandbox runs the build steps in new namespaces. We're root inside of
+// them, but unprivileged outside of them.
+func runSandbox(log *zap.SugaredLogger, output io.Writer, root string, spec ImageSpec, config *v1.Config, ids sandboxIDs) error {
+	workdir := config.WorkingDir
+	if workdir == "" {
+		workdir = "/"
+	}
+
+	network := "0"
+	if spec.RunNetwork {
+		network = "1"
+	}
+
+	args := append([]string{sandboxArg, root, workdir, network}, spec.Run...)
+	cmd := exec.Command("/proc/self/exe", args...)
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	cmd.Env = []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin", "HOME=/root"}
+	cmd.Env = append(cmd.Env, config.Env...)
+
+	cloneflags := syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC
+	if !spec.RunNetwork {
+		cloneflags |= syscall.CLONE_NEWNET
+	}
+
+	attr := &syscall.SysProcAttr{
+		Cloneflags:  uintptr(cloneflags),
+		Pdeathsig:   syscall.SIGKILL,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: ids.uid, Size: ids.size}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: ids.gid, Size: ids.size}},
+	}
+	// only root may allow setgroups, unprivileged users can only map themselves
+	attr.GidMappingsEnableSetgroups = os.Getuid() == 0
+	// root's own uid isn't mapped, so it would lose its capabilities on exec
+	attr.Credential = &syscall.Credential{Uid: 0, Gid: 0, NoSetGroups: os.Getuid() != 0}
+	cmd.SysProcAttr = attr
+
+	log.Infof("run %d build steps", len(spec.Run))
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("build steps failed: %w", err)
+	}
+
+	return nil
+}
+
+// sandboxBind makes a host file or directory available inside of the sandbox
+func sandboxBind(src string, dst string, flags uintptr) error {
+	err := syscall.Mount(src, dst, "", syscall.MS_BIND|flags, "")
+	if err != nil {
+		return fmt.Errorf("failed to bind `%s` to `%s`: %w", src, dst, err)
+	}
+
+	return nil
+}
+
+func setupSandbox(root string, workdir string, network bool) error {
+	// don't propagate anything to the host
+	err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+	if err != nil {
+		return fmt.Errorf("failed to make mounts private: %w", err)
+	}
+
+	err = sandboxBind(root, root, syscall.MS_REC)
+	if err != nil {
+		return err
+	}
+
+	for dir := range sandboxMounts {
+		err = os.MkdirAll(filepath.Join(root, dir), 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the one of the host would leak its processes into the sandbox, so fail
+	// if we can't mount our own, e.g. in containers with a partially hidden
+	// /proc
+	err = syscall.Mount("proc", filepath.Join(root, "proc"), "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "")
+	if err != nil {
+		return fmt.Errorf("failed to mount /proc: %w", err)
+	}
+
+	dev := filepath.Join(root, "dev")
+	err = syscall.Mount("tmpfs", dev, "tmpfs", syscall.MS_NOSUID, "mode=0755")
+	if err != nil {
+		return fmt.Errorf("failed to mount /dev: %w", err)
+	}
+	for _, device := range []string{"null", "zero", "full", "random", "urandom", "tty"} {
+		path := filepath.Join(dev, device)
+		err = os.WriteFile(path, nil, 0644)
+		if err != nil {
+			return err
+		}
+
+		err = sandboxBind(filepath.Join("/dev", device), path, 0)
+		if err != nil {
+			return err
+		}
+	}
+	for _, dir := range []string{"pts", "shm"} {
+		err = os.Mkdir(filepath.Join(dev, dir), 0755)
+		if err != nil {
+			return err
+		}
+	}
+	err = syscall.Mount("tmpfs", filepath.Join(dev, "shm"), "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777")
+	if err != nil {
+		return fmt.Errorf("failed to mount /dev/shm: %w", err)
+	}
+	for name, target := range map[string]string{
+		"fd":     "/proc/self/fd",
+		"stdin":  "/proc/self/fd/0",
+		"stdout": "/proc/self/fd/1",
+		"stderr": "/proc/self/fd/2",
+	} {
+		err = os.Symlink(target, filepath.Join(dev, name))
+		if err != nil {
+			return err
+		}
+	}
+
+	if network {
+		resolvConf := filepath.Join(root, "etc/resolv.conf")
+		if info, err := os.Lstat(resolvConf); err == nil && info.Mode().IsRegular() {
+			err = sandboxBind("/etc/resolv.conf", resolvConf, 0)
+			if err != nil {
+				return err
+			}
+		} else {
+			log.Warnf("/etc/resolv.conf of the image isn't a file, DNS might not work")
+		}
+	}
+
+	err = syscall.Sethostname([]byte("lxdocker-build"))
+	if err != nil {
+		return fmt.Errorf("failed to set hostname: %w", err)
+	}
+
+	// unlike chroot, this can't be escaped by another chroot since the old
+	// root isn't reachable anymore
+	err = os.Chdir(root)
+	if err != nil {
+		return err
+	}
+
+	err = syscall.PivotRoot(".", ".")
+	if err != nil {
+		return fmt.Errorf("failed to pivot_root: %w", err)
+	}
+
+	// the old root is stacked on top of the new one now
+	err = syscall.Unmount(".", syscall.MNT_DETACH)
+	if err != nil {
+		return fmt.Errorf("failed to detach the old root: %w", err)
+	}
+
+	err = os.Chdir(workdir)
+	if err != nil {
+		return fmt.Errorf("failed to change to workdir: %w", err)
+	}
+
+	return nil
+}
+
+// sandboxMain is the entrypoint of the sandbox. It runs as PID 1 in new
+// namespaces created by runSandbox.
+func sandboxMain(args []string) {
+	log = common.MakeLogger()
+
+	if len(args) < 3 {
+		log.Fatalf("usage: %s ROOTFS WORKDIR NETWORK [STEP]...", sandboxArg)
+	}
+
+	err := setupSandbox(args[0], args[1], args[2] == "1")
+	if err != nil {
+		log.Fatalf("failed to setup sandbox: %v", err)
+	}
+
+	for _, step := range args[3:] {
+		log.Infof("RUN %s", step)
+
+		cmd := exec.Command("/bin/sh", "-c", step)
+		cmd.Stdin = nil
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		err = cmd.Run()
+		if err != nil {
+			log.Fatalf("build step failed: %v", err)
+		}
+	}
+}
+
+// removeUnusedRunLayers deletes cached layers of build steps which aren't
+// used by any version of any image anymore.
+func removeUnusedRunLayers(ociDir string, imageDir string) error {
+	used := map[string]bool{}
+
+	files, err := filepath.Glob(filepath.Join(imageDir, "*.meta"))
+	if err != nil {
+		return fmt.Errorf("failed to list metadata: %w", err)
+	}
+	for _, path := range files {
+		rootMeta, err := common.ReadRootfsMetaData(path)
+		if err != nil {
+			// we don't know what it uses, so keep everything
+			log.Warnf("keep all layers of build steps: %v", err)
+			return nil
+		}
+
+		for _, version := range rootMeta.Versions() {
+			if version.RunLayer != "" {
+				used[fmt.Sprintf("%s.tar", version.RunLayer)] = true
+			}
+		}
+	}
+
+	layers, err := os.ReadDir(filepath.Join(ociDir, runLayerDir))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read layer dir: %w", err)
+	}
+
+	for _, layer := range layers {
+		if used[layer.Name()] {
+			continue
+		}
+
+		log.Debugf("delete unused layer of build steps `%s`", layer.Name())
+		err = os.Remove(filepath.Join(ociDir, runLayerDir, layer.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to delete unused layer `%s`: %w", layer.Name(), err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testTree creates `entries` in `root`, in the notation of testLayer
+func testTree(t *testing.T, root string, entries ...string) {
+	t.Helper()
+
+	for _, entry := range entries {
+		var err error
+		switch {
+		case strings.HasSuffix(entry, "/"):
+			err = os.MkdirAll(filepath.Join(root, entry), 0755)
+		case strings.Contains(entry, "->"):
+			parts := strings.SplitN(entry, "->", 2)
+			err = os.Symlink(parts[1], filepath.Join(root, parts[0]))
+		default:
+			parts := strings.SplitN(entry, "=", 2)
+			err = os.WriteFile(filepath.Join(root, parts[0]), []byte(parts[1]), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// diffLayer snapshots `root`, calls `change` and returns the diff layer
+func diffLayer(t *testing.T, root string, owners map[string]fileOwner, change func()) []*tar.Header {
+	t.Helper()
+
+	before, err := snapshotTree(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ctimes might only be as precise as a timer tick
+	time.Sleep(20 * time.Millisecond)
+	change()
+
+	layerPath := filepath.Join(t.TempDir(), "layer.tar")
+	ids := sandboxIDs{uid: os.Getuid(), gid: os.Getgid(), size: 1}
+	err = writeDiffLayer(root, before, owners, layerPath, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(layerPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	headers := []*tar.Header{}
+	tarReader := tar.NewReader(file)
+	for {
+		header, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers = append(headers, header)
+	}
+
+	return headers
+}
+
+func TestSecurePath(t *testing.T) {
+	root := t.TempDir()
+	testTree(t, root, "dir/", "file=", "link->/tmp", "dirlink->dir")
+
+	tests := []struct {
+		name string
+		want string
+		err  bool
+	}{
+		{name: "/", want: root},
+		{name: "dir/new", want: filepath.Join(root, "dir/new")},
+		{name: "missing/parents/new", want: filepath.Join(root, "missing/parents/new")},
+		{name: "../../etc/passwd", want: filepath.Join(root, "etc/passwd")},
+		{name: "link", want: filepath.Join(root, "link")},
+		{name: "link/passwd", err: true},
+		{name: "dirlink/new", err: true},
+		{name: "dir/../link/passwd", err: true},
+		{name: "file/new", err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := securePath(root, test.name)
+			if test.err {
+				if err == nil {
+					t.Errorf("got `%s`, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("got `%s`, want `%s`", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReadSubordinateIDs(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string
+		wantStart int
+		wantCount int
+		err       bool
+	}{
+		{
+			name:      "by name",
+			data:      "other:100000:65536\nroot:200000:65536\n",
+			wantStart: 200000,
+			wantCount: 65536,
+		},
+		{
+			name:      "by id",
+			data:      "0:300000:100000\n",
+			wantStart: 300000,
+			wantCount: 100000,
+		},
+		{
+			name:      "too small ranges are skipped",
+			data:      "root:100000:1000\nroot:200000:65536\n",
+			wantStart: 200000,
+			wantCount: 65536,
+		},
+		{
+			name:      "invalid lines are skipped",
+			data:      "root\nroot:x:65536\nroot:0:65536\n  root:400000:65536  \n",
+			wantStart: 400000,
+			wantCount: 65536,
+		},
+		{
+			name: "no range",
+			data: "other:100000:65536\n",
+			err:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "subuid")
+			if err := os.WriteFile(path, []byte(test.data), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			start, count, err := readSubordinateIDs(path, "root", 0)
+			if test.err {
+				if err == nil {
+					t.Errorf("got %d:%d, want an error", start, count)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if start != test.wantStart || count != test.wantCount {
+				t.Errorf("got %d:%d, want %d:%d", start, count, test.wantStart, test.wantCount)
+			}
+		})
+	}
+}
+
+func TestSandboxIDs(t *testing.T) {
+	ids := sandboxIDs{uid: 100000, gid: 200000, size: 65536}
+
+	hostTests := []struct {
+		uid, gid         int
+		wantUid, wantGid int
+		err              bool
+	}{
+		{uid: 0, gid: 0, wantUid: 100000, wantGid: 200000},
+		{uid: 33, gid: 34, wantUid: 100033, wantGid: 200034},
+		{uid: 65535, gid: 65535, wantUid: 165535, wantGid: 265535},
+		{uid: 65536, gid: 0, err: true},
+		{uid: 0, gid: 65536, err: true},
+		{uid: -1, gid: 0, err: true},
+	}
+	for _, test := range hostTests {
+		uid, gid, err := ids.hostIDs(test.uid, test.gid)
+		if test.err {
+			if err == nil {
+				t.Errorf("hostIDs(%d, %d) = %d:%d, want an error", test.uid, test.gid, uid, gid)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("hostIDs(%d, %d): %v", test.uid, test.gid, err)
+		} else if uid != test.wantUid || gid != test.wantGid {
+			t.Errorf("hostIDs(%d, %d) = %d:%d, want %d:%d", test.uid, test.gid, uid, gid, test.wantUid, test.wantGid)
+		}
+	}
+
+	sandboxTests := []struct {
+		uid, gid         int
+		wantUid, wantGid int
+	}{
+		{uid: 100000, gid: 200000, wantUid: 0, wantGid: 0},
+		{uid: 100033, gid: 200034, wantUid: 33, wantGid: 34},
+		// not mapped
+		{uid: 0, gid: 0, wantUid: 0, wantGid: 0},
+		{uid: 165536, gid: 265536, wantUid: 165536, wantGid: 265536},
+	}
+	for _, test := range sandboxTests {
+		uid, gid := ids.sandboxIDs(test.uid, test.gid)
+		if uid != test.wantUid || gid != test.wantGid {
+			t.Errorf("sandboxIDs(%d, %d) = %d:%d, want %d:%d", test.uid, test.gid, uid, gid, test.wantUid, test.wantGid)
+		}
+	}
+}
+
+func TestWriteDiffLayer(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		change  func(root string) error
+		want    []string
+	}{
+		{
+			name:    "unchanged files are skipped",
+			entries: []string{"etc/", "etc/a=old"},
+			change:  func(root string) error { return nil },
+			want:    []string{},
+		},
+		{
+			name:    "modified file",
+			entries: []string{"etc/", "etc/a=old", "etc/b=old"},
+			change: func(root string) error {
+				return os.WriteFile(filepath.Join(root, "etc/a"), []byte("newer"), 0644)
+			},
+			want: []string{"etc/a=newer"},
+		},
+		{
+			name:    "new file",
+			entries: []string{"etc/", "etc/a=old"},
+			change: func(root string) error {
+				return os.WriteFile(filepath.Join(root, "etc/b"), []byte("new"), 0644)
+			},
+			want: []string{"etc/", "etc/b=new"},
+		},
+		{
+			name:    "replaced symlink",
+			entries: []string{"link->old"},
+			change: func(root string) error {
+				if err := os.Remove(filepath.Join(root, "link")); err != nil {
+					return err
+				}
+				return os.Symlink("new", filepath.Join(root, "link"))
+			},
+			want: []string{"link->new"},
+		},
+		{
+			name:    "deleted file",
+			entries: []string{"a=old", "etc/", "etc/b=old"},
+			change: func(root string) error {
+				if err := os.Remove(filepath.Join(root, "a")); err != nil {
+					return err
+				}
+				return os.Remove(filepath.Join(root, "etc/b"))
+			},
+			want: []string{"etc/", ".wh.a=", "etc/.wh.b="},
+		},
+		{
+			name:    "children of deleted dirs are skipped",
+			entries: []string{"etc/", "etc/sub/", "etc/sub/a=old", "etc/sub/deeper/", "etc/sub/deeper/b=old"},
+			change: func(root string) error {
+				return os.RemoveAll(filepath.Join(root, "etc/sub"))
+			},
+			want: []string{"etc/", "etc/.wh.sub="},
+		},
+		{
+			name:    "hard links",
+			entries: []string{"etc/"},
+			change: func(root string) error {
+				if err := os.WriteFile(filepath.Join(root, "etc/a"), []byte("linked"), 0644); err != nil {
+					return err
+				}
+				return os.Link(filepath.Join(root, "etc/a"), filepath.Join(root, "etc/b"))
+			},
+			want: []string{"etc/", "etc/a=linked", "etc/b=>etc/a"},
+		},
+		{
+			name:    "sandbox mounts are skipped",
+			entries: []string{"proc/"},
+			change: func(root string) error {
+				return os.WriteFile(filepath.Join(root, "proc/a"), []byte("new"), 0644)
+			},
+			want: []string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			testTree(t, root, test.entries...)
+
+			headers := diffLayer(t, root, nil, func() {
+				if err := test.change(root); err != nil {
+					t.Fatal(err)
+				}
+			})
+
+			got := []string{}
+			for _, header := range headers {
+				switch header.Typeflag {
+				case tar.TypeDir:
+					got = append(got, header.Name+"/")
+				case tar.TypeSymlink:
+					got = append(got, header.Name+"->"+header.Linkname)
+				case tar.TypeLink:
+					got = append(got, header.Name+"=>"+header.Linkname)
+				default:
+					contents, err := os.ReadFile(filepath.Join(root, header.Name))
+					if errors.Is(err, os.ErrNotExist) {
+						contents = nil
+					} else if err != nil {
+						t.Fatal(err)
+					}
+					got = append(got, header.Name+"="+string(contents))
+				}
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestWriteDiffLayerKeepsOwners(t *testing.T) {
+	root := t.TempDir()
+	testTree(t, root, "www/", "www/index.html=old", "other=old")
+
+	owners := map[string]fileOwner{
+		"www":            {uid: 33, gid: 33},
+		"www/index.html": {uid: 33, gid: 34},
+		// replaced by a step, but the path belongs to the image
+		"other": {uid: 1000, gid: 1000},
+	}
+
+	headers := diffLayer(t, root, owners, func() {
+		if err := os.Chmod(filepath.Join(root, "www"), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(filepath.Join(root, "www/index.html"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, "www/new"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Remove(filepath.Join(root, "other")); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, "other"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	got := map[string]fileOwner{}
+	for _, header := range headers {
+		got[header.Name] = fileOwner{uid: header.Uid, gid: header.Gid}
+	}
+	want := map[string]fileOwner{
+		"www":            {uid: 33, gid: 33},
+		"www/index.html": {uid: 33, gid: 34},
+		"www/new":        {uid: 0, gid: 0},
+		"other":          {uid: 1000, gid: 1000},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,1118 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"go.uber.org/zap"
+)
+
+// This is a minimal squashfs 4.0 writer which gets fed with the same headers
+// and contents that we'd write to a tar file. Data blocks get compressed in
+// parallel, everything else is kept in memory until Close writes the tables.
+// See https://dr-emann.github.io/squashfs/ for a description of the format.
+
+const (
+	squashfsMagic         = 0x73717368
+	squashfsBlockSize     = 128 * 1024
+	squashfsBlockLog      = 17
+	squashfsMetadataSize  = 8192
+	squashfsInvalid       = 0xFFFFFFFF
+	squashfsInvalidTable  = 0xFFFFFFFFFFFFFFFF
+	squashfsSuperblockLen = 96
+
+	squashfsFlagNoXattrs = 0x0200
+
+	squashfsDataUncompressed     = 1 << 24
+	squashfsMetadataUncompressed = 1 << 15
+
+	squashfsDirCount   = 256
+	squashfsNameLength = 256
+)
+
+const (
+	squashfsTypeDir = iota + 1
+	squashfsTypeFile
+	squashfsTypeSymlink
+	squashfsTypeBlock
+	squashfsTypeChar
+	squashfsTypeFifo
+	squashfsTypeSocket
+
+	// extended types are the basic ones plus this offset
+	squashfsTypeExtended = 7
+)
+
+var squashfsXattrPrefixes = []string{"user.", "trusted.", "security."}
+
+type squashfsCompressor interface {
+	id() uint16
+	compress(data []byte) ([]byte, error)
+}
+
+type squashfsGzip struct{}
+
+func (squashfsGzip) id() uint16 { return 1 }
+
+func (squashfsGzip) compress(data []byte) ([]byte, error) {
+	var out bytes.Buffer
+
+	// squashfs calls it gzip, but it's actually zlib
+	w := zlib.NewWriter(&out)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
+
+type squashfsXz struct{}
+
+func (squashfsXz) id() uint16 { return 4 }
+
+func (squashfsXz) compress(data []byte) ([]byte, error) {
+	var out bytes.Buffer
+
+	// the kernel expects the dictionary to be no bigger than a block and only
+	// supports CRC32 checksums
+	config := xz.WriterConfig{
+		DictCap:  squashfsBlockSize,
+		CheckSum: xz.CRC32,
+	}
+	w, err := config.NewWriter(&out)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
+
+type squashfsZstd struct {
+	encoder *zstd.Encoder
+}
+
+func (squashfsZstd) id() uint16 { return 6 }
+
+func (c squashfsZstd) compress(data []byte) ([]byte, error) {
+	return c.encoder.EncodeAll(data, nil), nil
+}
+
+func newSquashfsCompressor(compression string) (squashfsCompressor, error) {
+	switch compression {
+	case "gzip":
+		return squashfsGzip{}, nil
+	case "xz":
+		return squashfsXz{}, nil
+	case "zstd":
+		// the kernel doesn't support windows bigger than a block
+		encoder, err := zstd.NewWriter(nil, zstd.WithWindowSize(squashfsBlockSize))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd encoder: %w", err)
+		}
+		return squashfsZstd{encoder: encoder}, nil
+	default:
+		return nil, fmt.Errorf("unsupported squashfs compression: %s", compression)
+	}
+}
+
+// squashfsBlock is a data or fragment block. pos and size get filled in once
+// it was written to the output.
+type squashfsBlock struct {
+	data []byte
+	done chan struct{}
+	err  error
+
+	pos  uint64
+	size uint32
+}
+
+type squashfsXattr struct {
+	name  string
+	value string
+}
+
+type squashfsInode struct {
+	typeflag byte
+	mode     int64
+	uid      uint32
+	gid      uint32
+	mtime    uint32
+	linkname string
+	devmajor int64
+	devminor int64
+	xattrs   []squashfsXattr
+
+	// regular files
+	size           uint64
+	blocks         []*squashfsBlock
+	fragment       uint32
+	fragmentOffset uint32
+
+	// directories
+	children map[string]*squashfsInode
+
+	nlink   uint32
+	number  uint32
+	ref     uint64
+	written bool
+}
+
+func (inode *squashfsInode) isDir() bool {
+	return inode.typeflag == tar.TypeDir
+}
+
+// squashfsMetadataWriter collects data for one of the metadata tables and
+// splits it into (compressed) blocks.
+type squashfsMetadataWriter struct {
+	compressor squashfsCompressor
+	out        bytes.Buffer
+	block      []byte
+	// start of every block relative to the start of the table
+	blocks []uint64
+	// uncompressed size
+	size uint64
+	err  error
+}
+
+// ref returns the location the next write will end up at
+func (m *squashfsMetadataWriter) ref() uint64 {
+	return uint64(m.out.Len())<<16 | uint64(len(m.block))
+}
+
+func (m *squashfsMetadataWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	m.size += uint64(n)
+
+	for len(p) > 0 {
+		count := squashfsMetadataSize - len(m.block)
+		if count > len(p) {
+			count = len(p)
+		}
+
+		m.block = append(m.block, p[:count]...)
+		p = p[count:]
+
+		if len(m.block) == squashfsMetadataSize {
+			m.flush()
+		}
+	}
+
+	return n, m.err
+}
+
+func (m *squashfsMetadataWriter) flush() {
+	if len(m.block) == 0 || m.err != nil {
+		return
+	}
+
+	m.blocks = append(m.blocks, uint64(m.out.Len()))
+
+	data, err := m.compressor.compress(m.block)
+	if err != nil {
+		m.err = fmt.Errorf("failed to compress metadata: %w", err)
+		return
+	}
+
+	header := uint16(len(data))
+	if len(data) >= len(m.block) {
+		data = m.block
+		header = uint16(len(data)) | squashfsMetadataUncompressed
+	}
+
+	binary.Write(&m.out, binary.LittleEndian, header)
+	m.out.Write(data)
+	m.block = m.block[:0]
+}
+
+func (m *squashfsMetadataWriter) writeStruct(data any) {
+	binary.Write(m, binary.LittleEndian, data)
+}
+
+type SquashfsWriter struct {
+	log        *zap.SugaredLogger
+	w          io.WriteSeeker
+	compressor squashfsCompressor
+	mtime      uint32
+
+	// the first error, after which nothing gets written anymore
+	err error
+	// xattrs we dropped because squashfs doesn't support them
+	droppedXattrs map[string]bool
+
+	root *squashfsInode
+
+	// the regular file that's currently being written
+	current   *squashfsInode
+	remaining int64
+	block     []byte
+
+	fragment  []byte
+	fragments []*squashfsBlock
+
+	// blocks are compressed in parallel but written in order
+	workers  chan struct{}
+	queue    chan *squashfsBlock
+	finished chan struct{}
+	pos      uint64
+	writeErr error
+
+	ids       []uint32
+	idMap     map[uint32]uint16
+	xattrIDs  []xattrID
+	xattrMap  map[string]uint32
+	xattrData squashfsMetadataWriter
+}
+
+type xattrID struct {
+	Ref   uint64
+	Count uint32
+	Size  uint32
+}
+
+func NewSquashfsWriter(log *zap.SugaredLogger, w io.WriteSeeker, compression string) (*SquashfsWriter, error) {
+	compressor, err := newSquashfsCompressor(compression)
+	if err != nil {
+		return nil, err
+	}
+
+	// the superblock gets written by Close
+	if _, err := w.Write(make([]byte, squashfsSuperblockLen)); err != nil {
+		return nil, fmt.Errorf("failed to reserve superblock: %w", err)
+	}
+
+	mtime := uint32(time.Now().UTC().Unix())
+	sw := &SquashfsWriter{
+		log:           log,
+		w:             w,
+		compressor:    compressor,
+		mtime:         mtime,
+		droppedXattrs: map[string]bool{},
+		root: &squashfsInode{
+			typeflag: tar.TypeDir,
+			mode:     0755,
+			mtime:    mtime,
+			children: map[string]*squashfsInode{},
+		},
+		workers:   make(chan struct{}, runtime.NumCPU()),
+		queue:     make(chan *squashfsBlock, runtime.NumCPU()),
+		finished:  make(chan struct{}),
+		pos:       squashfsSuperblockLen,
+		idMap:     map[uint32]uint16{},
+		xattrMap:  map[string]uint32{},
+		xattrData: squashfsMetadataWriter{compressor: compressor},
+	}
+
+	go sw.writeBlocks()
+
+	return sw, nil
+}
+
+func (sw *SquashfsWriter) writeBlocks() {
+	defer close(sw.finished)
+
+	for block := range sw.queue {
+		<-block.done
+
+		if sw.writeErr != nil {
+			continue
+		}
+		if block.err != nil {
+			sw.writeErr = block.err
+			continue
+		}
+
+		if _, err := sw.w.Write(block.data); err != nil {
+			sw.writeErr = fmt.Errorf("failed to write block: %w", err)
+			continue
+		}
+
+		block.pos = sw.pos
+		sw.pos += uint64(len(block.data))
+		block.data = nil
+	}
+}
+
+func (sw *SquashfsWriter) submitBlock(data []byte) *squashfsBlock {
+	block := &squashfsBlock{
+		data: data,
+		done: make(chan struct{}),
+	}
+
+	sw.workers <- struct{}{}
+	go func() {
+		defer func() {
+			<-sw.workers
+			close(block.done)
+		}()
+
+		compressed, err := sw.compressor.compress(block.data)
+		if err != nil {
+			block.err = fmt.Errorf("failed to compress block: %w", err)
+			return
+		}
+
+		if len(compressed) < len(block.data) {
+			block.data = compressed
+			block.size = uint32(len(compressed))
+		} else {
+			block.size = uint32(len(block.data)) | squashfsDataUncompressed
+		}
+	}()
+
+	sw.queue <- block
+
+	return block
+}
+
+func (sw *SquashfsWriter) flushFragment() {
+	if len(sw.fragment) == 0 {
+		return
+	}
+
+	sw.fragments = append(sw.fragments, sw.submitBlock(sw.fragment))
+	sw.fragment = nil
+}
+
+func (sw *SquashfsWriter) finishFile() error {
+	if sw.current == nil {
+		return nil
+	}
+
+	inode := sw.current
+	sw.current = nil
+
+	if sw.remaining != 0 {
+		return fmt.Errorf("missed writing %d bytes", sw.remaining)
+	}
+
+	// the tail of the file goes into a fragment shared with other files
+	if len(sw.block) > 0 {
+		if len(sw.fragment)+len(sw.block) > squashfsBlockSize {
+			sw.flushFragment()
+		}
+
+		inode.fragment = uint32(len(sw.fragments))
+		inode.fragmentOffset = uint32(len(sw.fragment))
+		sw.fragment = append(sw.fragment, sw.block...)
+		sw.block = nil
+	}
+
+	return nil
+}
+
+func (sw *SquashfsWriter) lookup(name string) (*squashfsInode, error) {
+	inode := sw.root
+
+	if name == "." {
+		return inode, nil
+	}
+
+	for _, component := range strings.Split(name, "/") {
+		if !inode.isDir() {
+			return nil, fmt.Errorf("`%s` is not a directory", name)
+		}
+
+		child, ok := inode.children[component]
+		if !ok {
+			return nil, fmt.Errorf("`%s` doesn't exist", name)
+		}
+		inode = child
+	}
+
+	return inode, nil
+}
+
+// mkdirAll returns the directory `name` and creates all missing directories
+// on the way. Tar files don't always contain all of their parent directories.
+func (sw *SquashfsWriter) mkdirAll(name string) (*squashfsInode, error) {
+	inode := sw.root
+
+	if name == "." {
+		return inode, nil
+	}
+
+	for _, component := range strings.Split(name, "/") {
+		child, ok := inode.children[component]
+		if !ok {
+			child = &squashfsInode{
+				typeflag: tar.TypeDir,
+				mode:     0755,
+				mtime:    sw.mtime,
+				children: map[string]*squashfsInode{},
+			}
+			inode.children[component] = child
+		}
+
+		if !child.isDir() {
+			return nil, fmt.Errorf("parent `%s` of `%s` is not a directory", component, name)
+		}
+		inode = child
+	}
+
+	return inode, nil
+}
+
+func squashfsCleanName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+func (sw *SquashfsWriter) WriteHeader(header *tar.Header) error {
+	if sw.err != nil {
+		return sw.err
+	}
+
+	sw.err = sw.writeHeader(header)
+	return sw.err
+}
+
+// supportedXattr returns whether squashfs can store the xattr `name`
+func supportedXattr(name string) bool {
+	for _, prefix := range squashfsXattrPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (sw *SquashfsWriter) writeHeader(header *tar.Header) error {
+	if err := sw.finishFile(); err != nil {
+		return err
+	}
+
+	// global PAX headers don't describe a file
+	if header.Typeflag == tar.TypeXGlobalHeader {
+		return nil
+	}
+
+	name := squashfsCleanName(header.Name)
+	if name == "" {
+		name = "."
+	}
+
+	mtime := header.ModTime.Unix()
+	if mtime < 0 {
+		mtime = 0
+	}
+
+	inode := &squashfsInode{
+		typeflag: header.Typeflag,
+		mode:     header.Mode,
+		uid:      uint32(header.Uid),
+		gid:      uint32(header.Gid),
+		mtime:    uint32(mtime),
+		linkname: header.Linkname,
+		devmajor: header.Devmajor,
+		devminor: header.Devminor,
+		fragment: squashfsInvalid,
+	}
+
+	for key, value := range header.PAXRecords {
+		if !strings.HasPrefix(key, "SCHILY.xattr.") {
+			continue
+		}
+
+		xattr := squashfsXattr{
+			name:  strings.TrimPrefix(key, "SCHILY.xattr."),
+			value: value,
+		}
+
+		// e.g. ACLs, which LXD can't shift anyway
+		if !supportedXattr(xattr.name) {
+			if !sw.droppedXattrs[xattr.name] {
+				sw.log.Warnf("squashfs doesn't support xattr `%s`, drop it from `%s` and all other files", xattr.name, header.Name)
+				sw.droppedXattrs[xattr.name] = true
+			}
+			continue
+		}
+
+		inode.xattrs = append(inode.xattrs, xattr)
+	}
+	sort.Slice(inode.xattrs, func(i, j int) bool {
+		return inode.xattrs[i].name < inode.xattrs[j].name
+	})
+
+	if name == "." {
+		if header.Typeflag != tar.TypeDir {
+			return fmt.Errorf("root has to be a directory")
+		}
+
+		inode.children = sw.root.children
+		sw.root = inode
+		return nil
+	}
+
+	basename := path.Base(name)
+	if len(basename) > squashfsNameLength {
+		return fmt.Errorf("name of `%s` is too long", name)
+	}
+
+	parent, err := sw.mkdirAll(path.Dir(name))
+	if err != nil {
+		return err
+	}
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		inode.children = map[string]*squashfsInode{}
+
+		// keep children of implicitly created directories
+		if existing, ok := parent.children[basename]; ok && existing.isDir() {
+			inode.children = existing.children
+		}
+	case tar.TypeLink:
+		target, err := sw.lookup(squashfsCleanName(header.Linkname))
+		if err != nil {
+			return fmt.Errorf("hardlink `%s`: %w", name, err)
+		}
+		if target.isDir() {
+			return fmt.Errorf("hardlink `%s` points to a directory", name)
+		}
+
+		inode = target
+	case tar.TypeReg, tar.TypeRegA:
+		inode.typeflag = tar.TypeReg
+		inode.size = uint64(header.Size)
+		sw.current = inode
+		sw.remaining = header.Size
+	case tar.TypeSymlink, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+	default:
+		return fmt.Errorf("unsupported type %q of `%s`", header.Typeflag, name)
+	}
+
+	parent.children[basename] = inode
+
+	return nil
+}
+
+func (sw *SquashfsWriter) Write(p []byte) (int, error) {
+	if sw.err != nil {
+		return 0, sw.err
+	}
+	if int64(len(p)) > sw.remaining {
+		return 0, tar.ErrWriteTooLong
+	}
+
+	n := len(p)
+
+	for len(p) > 0 {
+		count := squashfsBlockSize - len(sw.block)
+		if count > len(p) {
+			count = len(p)
+		}
+
+		sw.block = append(sw.block, p[:count]...)
+		p = p[count:]
+		sw.remaining -= int64(count)
+
+		if len(sw.block) == squashfsBlockSize {
+			sw.current.blocks = append(sw.current.blocks, sw.submitBlock(sw.block))
+			sw.block = nil
+		}
+	}
+
+	return n, nil
+}
+
+func (sw *SquashfsWriter) id(id uint32) uint16 {
+	if index, ok := sw.idMap[id]; ok {
+		return index
+	}
+
+	index := uint16(len(sw.ids))
+	sw.ids = append(sw.ids, id)
+	sw.idMap[id] = index
+
+	return index
+}
+
+func (sw *SquashfsWriter) xattrIndex(xattrs []squashfsXattr) (uint32, error) {
+	if len(xattrs) == 0 {
+		return squashfsInvalid, nil
+	}
+
+	var key strings.Builder
+	for _, xattr := range xattrs {
+		fmt.Fprintf(&key, "%d:%s%d:%s", len(xattr.name), xattr.name, len(xattr.value), xattr.value)
+	}
+	if index, ok := sw.xattrMap[key.String()]; ok {
+		return index, nil
+	}
+
+	id := xattrID{Ref: sw.xattrData.ref()}
+
+	for _, xattr := range xattrs {
+		prefix := -1
+		for i, candidate := range squashfsXattrPrefixes {
+			if strings.HasPrefix(xattr.name, candidate) {
+				prefix = i
+				break
+			}
+		}
+		if prefix < 0 {
+			return 0, fmt.Errorf("unsupported xattr `%s`", xattr.name)
+		}
+
+		name := strings.TrimPrefix(xattr.name, squashfsXattrPrefixes[prefix])
+		sw.xattrData.writeStruct([]uint16{uint16(prefix), uint16(len(name))})
+		sw.xattrData.Write([]byte(name))
+		sw.xattrData.writeStruct(uint32(len(xattr.value)))
+		sw.xattrData.Write([]byte(xattr.value))
+
+		id.Count++
+		id.Size += uint32(4 + len(name) + 4 + len(xattr.value))
+	}
+
+	index := uint32(len(sw.xattrIDs))
+	sw.xattrIDs = append(sw.xattrIDs, id)
+	sw.xattrMap[key.String()] = index
+
+	return index, sw.xattrData.err
+}
+
+// numberInodes assigns inode numbers so the children of a directory are
+// numbered consecutively. It also counts the links to every inode.
+func (sw *SquashfsWriter) numberInodes(dir *squashfsInode, next *uint32) {
+	names := sortedNames(dir)
+
+	dir.nlink = 2
+	for _, name := range names {
+		child := dir.children[name]
+		if child.isDir() {
+			dir.nlink++
+		} else {
+			child.nlink++
+		}
+
+		if child.number == 0 {
+			*next++
+			child.number = *next
+		}
+	}
+
+	for _, name := range names {
+		child := dir.children[name]
+		if child.isDir() {
+			sw.numberInodes(child, next)
+		}
+	}
+}
+
+func sortedNames(dir *squashfsInode) []string {
+	names := make([]string, 0, len(dir.children))
+	for name := range dir.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func squashfsBasicType(inode *squashfsInode) uint16 {
+	switch inode.typeflag {
+	case tar.TypeDir:
+		return squashfsTypeDir
+	case tar.TypeSymlink:
+		return squashfsTypeSymlink
+	case tar.TypeBlock:
+		return squashfsTypeBlock
+	case tar.TypeChar:
+		return squashfsTypeChar
+	case tar.TypeFifo:
+		return squashfsTypeFifo
+	default:
+		return squashfsTypeFile
+	}
+}
+
+type squashfsInodeHeader struct {
+	Type   uint16
+	Mode   uint16
+	Uid    uint16
+	Gid    uint16
+	Mtime  uint32
+	Number uint32
+}
+
+type squashfsDirEntry struct {
+	name  string
+	inode *squashfsInode
+}
+
+// writeDirectory writes all inodes below `dir`, its listing and finally the
+// directory inode itself.
+func (sw *SquashfsWriter) writeDirectory(inodes *squashfsMetadataWriter, dirs *squashfsMetadataWriter, dir *squashfsInode, parent uint32) error {
+	names := sortedNames(dir)
+
+	for _, name := range names {
+		child := dir.children[name]
+		if child.isDir() {
+			if err := sw.writeDirectory(inodes, dirs, child, dir.number); err != nil {
+				return err
+			}
+		} else if !child.written {
+			if err := sw.writeInode(inodes, child, 0, 0, 0); err != nil {
+				return err
+			}
+		}
+	}
+
+	listingRef := dirs.ref()
+	listingStart := dirs.size
+
+	// entries are grouped by the metadata block their inode is in
+	for i := 0; i < len(names); {
+		block := uint32(dir.children[names[i]].ref >> 16)
+		base := dir.children[names[i]].number
+
+		count := 0
+		for i+count < len(names) && count < squashfsDirCount {
+			child := dir.children[names[i+count]]
+			delta := int64(child.number) - int64(base)
+			if uint32(child.ref>>16) != block || delta < -32768 || delta > 32767 {
+				break
+			}
+			count++
+		}
+
+		dirs.writeStruct([]uint32{uint32(count - 1), block, base})
+		for _, name := range names[i : i+count] {
+			child := dir.children[name]
+			dirs.writeStruct([]uint16{
+				uint16(child.ref & 0xFFFF),
+				uint16(int16(int64(child.number) - int64(base))),
+				squashfsBasicType(child),
+				uint16(len(name) - 1),
+			})
+			dirs.Write([]byte(name))
+		}
+
+		i += count
+	}
+
+	// the size includes the implicit `.` and `..` entries
+	size := uint32(dirs.size-listingStart) + 3
+
+	return sw.writeInode(inodes, dir, listingRef, size, parent)
+}
+
+func (sw *SquashfsWriter) writeInode(inodes *squashfsMetadataWriter, inode *squashfsInode, listingRef uint64, listingSize uint32, parent uint32) error {
+	xattr, err := sw.xattrIndex(inode.xattrs)
+	if err != nil {
+		return err
+	}
+
+	inodeType := squashfsBasicType(inode)
+	extended := xattr != squashfsInvalid
+
+	var blocksStart uint64
+	var blockSizes []uint32
+	for i, block := range inode.blocks {
+		if i == 0 {
+			blocksStart = block.pos
+		}
+		blockSizes = append(blockSizes, block.size)
+	}
+
+	switch inode.typeflag {
+	case tar.TypeDir:
+		extended = extended || listingSize > 0xFFFF
+	case tar.TypeReg:
+		extended = extended || inode.nlink > 1 || blocksStart > 0xFFFFFFFF || inode.size > 0xFFFFFFFF
+	}
+	if extended {
+		inodeType += squashfsTypeExtended
+	}
+
+	inode.ref = inodes.ref()
+	inode.written = true
+
+	inodes.writeStruct(squashfsInodeHeader{
+		Type:   inodeType,
+		Mode:   uint16(inode.mode & 07777),
+		Uid:    sw.id(inode.uid),
+		Gid:    sw.id(inode.gid),
+		Mtime:  inode.mtime,
+		Number: inode.number,
+	})
+
+	switch inode.typeflag {
+	case tar.TypeDir:
+		listingBlock := uint32(listingRef >> 16)
+		listingOffset := uint16(listingRef & 0xFFFF)
+		if extended {
+			inodes.writeStruct([]uint32{inode.nlink, listingSize, listingBlock, parent})
+			inodes.writeStruct([]uint16{0, listingOffset})
+			inodes.writeStruct(xattr)
+		} else {
+			inodes.writeStruct([]uint32{listingBlock, inode.nlink})
+			inodes.writeStruct([]uint16{uint16(listingSize), listingOffset})
+			inodes.writeStruct(parent)
+		}
+	case tar.TypeReg:
+		if extended {
+			inodes.writeStruct([]uint64{blocksStart, inode.size, 0})
+			inodes.writeStruct([]uint32{inode.nlink, inode.fragment, inode.fragmentOffset, xattr})
+		} else {
+			inodes.writeStruct([]uint32{uint32(blocksStart), inode.fragment, inode.fragmentOffset, uint32(inode.size)})
+		}
+		inodes.writeStruct(blockSizes)
+	case tar.TypeSymlink:
+		inodes.writeStruct([]uint32{inode.nlink, uint32(len(inode.linkname))})
+		inodes.Write([]byte(inode.linkname))
+		if extended {
+			inodes.writeStruct(xattr)
+		}
+	case tar.TypeBlock, tar.TypeChar:
+		major := uint32(inode.devmajor)
+		minor := uint32(inode.devminor)
+		inodes.writeStruct([]uint32{inode.nlink, (minor & 0xff) | (major&0xfff)<<8 | (minor&^0xff)<<12})
+		if extended {
+			inodes.writeStruct(xattr)
+		}
+	case tar.TypeFifo:
+		inodes.writeStruct(inode.nlink)
+		if extended {
+			inodes.writeStruct(xattr)
+		}
+	}
+
+	return inodes.err
+}
+
+// writeTable writes a metadata table followed by the list of its block
+// locations. It returns where that list starts.
+func (sw *SquashfsWriter) writeTable(table *squashfsMetadataWriter) (uint64, error) {
+	table.flush()
+	if table.err != nil {
+		return 0, table.err
+	}
+
+	start := sw.pos
+	if err := sw.writeRaw(table.out.Bytes()); err != nil {
+		return 0, err
+	}
+
+	indexStart := sw.pos
+	for _, block := range table.blocks {
+		if err := sw.writeStruct(start + block); err != nil {
+			return 0, err
+		}
+	}
+
+	return indexStart, nil
+}
+
+func (sw *SquashfsWriter) writeStruct(data any) error {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, data)
+
+	return sw.writeRaw(buf.Bytes())
+}
+
+func (sw *SquashfsWriter) writeRaw(data []byte) error {
+	if _, err := sw.w.Write(data); err != nil {
+		return fmt.Errorf("failed to write squashfs: %w", err)
+	}
+	sw.pos += uint64(len(data))
+
+	return nil
+}
+
+// Abort stops the writer without writing the rest of the image, e.g.
+// because reading the layers failed
+func (sw *SquashfsWriter) Abort() {
+	if sw.err == nil {
+		sw.err = fmt.Errorf("aborted")
+	}
+
+	sw.Close()
+}
+
+func (sw *SquashfsWriter) Close() error {
+	err := sw.err
+	if err == nil {
+		err = sw.finishFile()
+	}
+	if err == nil {
+		sw.flushFragment()
+	}
+
+	close(sw.queue)
+	<-sw.finished
+
+	if err == nil {
+		err = sw.writeErr
+	}
+	if err != nil {
+		sw.err = err
+		return err
+	}
+
+	inodeCount := uint32(1)
+	sw.root.number = inodeCount
+	sw.numberInodes(sw.root, &inodeCount)
+
+	inodes := squashfsMetadataWriter{compressor: sw.compressor}
+	dirs := squashfsMetadataWriter{compressor: sw.compressor}
+	if err := sw.writeDirectory(&inodes, &dirs, sw.root, inodeCount+1); err != nil {
+		return err
+	}
+
+	inodes.flush()
+	dirs.flush()
+	if inodes.err != nil {
+		return inodes.err
+	}
+	if dirs.err != nil {
+		return dirs.err
+	}
+
+	inodeTableStart := sw.pos
+	if err := sw.writeRaw(inodes.out.Bytes()); err != nil {
+		return err
+	}
+
+	directoryTableStart := sw.pos
+	if err := sw.writeRaw(dirs.out.Bytes()); err != nil {
+		return err
+	}
+
+	fragmentTable := squashfsMetadataWriter{compressor: sw.compressor}
+	for _, fragment := range sw.fragments {
+		fragmentTable.writeStruct(fragment.pos)
+		fragmentTable.writeStruct([]uint32{fragment.size, 0})
+	}
+	fragmentTableStart, err := sw.writeTable(&fragmentTable)
+	if err != nil {
+		return err
+	}
+
+	idTable := squashfsMetadataWriter{compressor: sw.compressor}
+	idTable.writeStruct(sw.ids)
+	idTableStart, err := sw.writeTable(&idTable)
+	if err != nil {
+		return err
+	}
+
+	flags := uint16(0)
+	xattrTableStart := uint64(squashfsInvalidTable)
+	if len(sw.xattrIDs) > 0 {
+		xattrDataStart := sw.pos
+		sw.xattrData.flush()
+		if sw.xattrData.err != nil {
+			return sw.xattrData.err
+		}
+		if err := sw.writeRaw(sw.xattrData.out.Bytes()); err != nil {
+			return err
+		}
+
+		xattrIDTable := squashfsMetadataWriter{compressor: sw.compressor}
+		xattrIDTable.writeStruct(sw.xattrIDs)
+		xattrIDTable.flush()
+		if xattrIDTable.err != nil {
+			return xattrIDTable.err
+		}
+
+		xattrIDStart := sw.pos
+		if err := sw.writeRaw(xattrIDTable.out.Bytes()); err != nil {
+			return err
+		}
+
+		xattrTableStart = sw.pos
+		if err := sw.writeStruct([]uint64{xattrDataStart}); err != nil {
+			return err
+		}
+		if err := sw.writeStruct([]uint32{uint32(len(sw.xattrIDs)), 0}); err != nil {
+			return err
+		}
+		for _, block := range xattrIDTable.blocks {
+			if err := sw.writeStruct(xattrIDStart + block); err != nil {
+				return err
+			}
+		}
+	} else {
+		flags |= squashfsFlagNoXattrs
+	}
+
+	bytesUsed := sw.pos
+
+	// loop devices need a multiple of 4K
+	if padding := (4096 - bytesUsed%4096) % 4096; padding > 0 {
+		if err := sw.writeRaw(make([]byte, padding)); err != nil {
+			return err
+		}
+	}
+
+	superblock := struct {
+		Magic               uint32
+		InodeCount          uint32
+		Mtime               uint32
+		BlockSize           uint32
+		FragmentCount       uint32
+		Compression         uint16
+		BlockLog            uint16
+		Flags               uint16
+		IDCount             uint16
+		VersionMajor        uint16
+		VersionMinor        uint16
+		RootInode           uint64
+		BytesUsed           uint64
+		IDTableStart        uint64
+		XattrIDTableStart   uint64
+		InodeTableStart     uint64
+		DirectoryTableStart uint64
+		FragmentTableStart  uint64
+		ExportTableStart    uint64
+	}{
+		Magic:               squashfsMagic,
+		InodeCount:          inodeCount,
+		Mtime:               sw.mtime,
+		BlockSize:           squashfsBlockSize,
+		FragmentCount:       uint32(len(sw.fragments)),
+		Compression:         sw.compressor.id(),
+		BlockLog:            squashfsBlockLog,
+		Flags:               flags,
+		IDCount:             uint16(len(sw.ids)),
+		VersionMajor:        4,
+		VersionMinor:        0,
+		RootInode:           sw.root.ref,
+		BytesUsed:           bytesUsed,
+		IDTableStart:        idTableStart,
+		XattrIDTableStart:   xattrTableStart,
+		InodeTableStart:     inodeTableStart,
+		DirectoryTableStart: directoryTableStart,
+		FragmentTableStart:  fragmentTableStart,
+		ExportTableStart:    squashfsInvalidTable,
+	}
+
+	if _, err := sw.w.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek to superblock: %w", err)
+	}
+	if err := binary.Write(sw.w, binary.LittleEndian, &superblock); err != nil {
+		return fmt.Errorf("failed to write superblock: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,752 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// testSquashfs decodes the images of SquashfsWriter, so we can check them
+// without squashfs-tools. It only supports what the writer produces.
+type testSquashfs struct {
+	data       []byte
+	superblock struct {
+		Magic               uint32
+		InodeCount          uint32
+		Mtime               uint32
+		BlockSize           uint32
+		FragmentCount       uint32
+		Compression         uint16
+		BlockLog            uint16
+		Flags               uint16
+		IDCount             uint16
+		VersionMajor        uint16
+		VersionMinor        uint16
+		RootInode           uint64
+		BytesUsed           uint64
+		IDTableStart        uint64
+		XattrIDTableStart   uint64
+		InodeTableStart     uint64
+		DirectoryTableStart uint64
+		FragmentTableStart  uint64
+		ExportTableStart    uint64
+	}
+}
+
+// testSquashfsEntry is a decoded inode
+type testSquashfsEntry struct {
+	typeflag byte
+	mode     int64
+	uid      uint32
+	gid      uint32
+	number   uint32
+	nlink    uint32
+	linkname string
+	devmajor int64
+	devminor int64
+	xattrs   map[string]string
+	contents string
+}
+
+func testDecompress(data []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+// testMetadataReader reads metadata blocks starting at `pos`
+type testMetadataReader struct {
+	fs  *testSquashfs
+	pos uint64
+	buf []byte
+}
+
+func (m *testMetadataReader) next() error {
+	if m.pos+2 > uint64(len(m.fs.data)) {
+		return io.ErrUnexpectedEOF
+	}
+
+	header := binary.LittleEndian.Uint16(m.fs.data[m.pos:])
+	size := uint64(header &^ squashfsMetadataUncompressed)
+	start := m.pos + 2
+	if start+size > uint64(len(m.fs.data)) {
+		return io.ErrUnexpectedEOF
+	}
+
+	block := m.fs.data[start : start+size]
+	if header&squashfsMetadataUncompressed == 0 {
+		var err error
+		block, err = testDecompress(block)
+		if err != nil {
+			return fmt.Errorf("failed to decompress metadata at %d: %w", m.pos, err)
+		}
+	}
+
+	m.buf = append(m.buf, block...)
+	m.pos = start + size
+
+	return nil
+}
+
+func (m *testMetadataReader) Read(p []byte) (int, error) {
+	for len(m.buf) < len(p) {
+		if err := m.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, m.buf)
+	m.buf = m.buf[n:]
+
+	return n, nil
+}
+
+// metadata returns a reader at `ref` of the table starting at `start`
+func (fs *testSquashfs) metadata(start uint64, ref uint64) (*testMetadataReader, error) {
+	m := &testMetadataReader{fs: fs, pos: start + ref>>16}
+	if err := m.next(); err != nil {
+		return nil, err
+	}
+	if int(ref&0xFFFF) > len(m.buf) {
+		return nil, fmt.Errorf("offset of ref %x is outside of its block", ref)
+	}
+	m.buf = m.buf[ref&0xFFFF:]
+
+	return m, nil
+}
+
+// lookupTable reads entry `index` of a table like the id or fragment table,
+// whose block locations start at `start`
+func (fs *testSquashfs) lookupTable(start uint64, index uint64, entry any) error {
+	entrySize := uint64(binary.Size(entry))
+	perBlock := squashfsMetadataSize / entrySize
+	location := binary.LittleEndian.Uint64(fs.data[start+8*(index/perBlock):])
+
+	m, err := fs.metadata(location, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(io.Discard, m, int64(entrySize*(index%perBlock))); err != nil {
+		return err
+	}
+
+	return binary.Read(m, binary.LittleEndian, entry)
+}
+
+func (fs *testSquashfs) id(index uint16) (uint32, error) {
+	var id uint32
+	err := fs.lookupTable(fs.superblock.IDTableStart, uint64(index), &id)
+
+	return id, err
+}
+
+func (fs *testSquashfs) xattrs(index uint32) (map[string]string, error) {
+	if index == squashfsInvalid {
+		return nil, nil
+	}
+
+	start := fs.superblock.XattrIDTableStart
+	dataStart := binary.LittleEndian.Uint64(fs.data[start:])
+
+	var id xattrID
+	if err := fs.lookupTable(start+16, uint64(index), &id); err != nil {
+		return nil, err
+	}
+
+	m, err := fs.metadata(dataStart, id.Ref)
+	if err != nil {
+		return nil, err
+	}
+
+	xattrs := map[string]string{}
+	for i := uint32(0); i < id.Count; i++ {
+		var header struct {
+			Type     uint16
+			NameSize uint16
+		}
+		if err := binary.Read(m, binary.LittleEndian, &header); err != nil {
+			return nil, err
+		}
+		name := make([]byte, header.NameSize)
+		if _, err := io.ReadFull(m, name); err != nil {
+			return nil, err
+		}
+		var valueSize uint32
+		if err := binary.Read(m, binary.LittleEndian, &valueSize); err != nil {
+			return nil, err
+		}
+		value := make([]byte, valueSize)
+		if _, err := io.ReadFull(m, value); err != nil {
+			return nil, err
+		}
+
+		xattrs[squashfsXattrPrefixes[header.Type&0xFF]+string(name)] = string(value)
+	}
+
+	return xattrs, nil
+}
+
+func (fs *testSquashfs) fileContents(blocksStart uint64, size uint64, fragment uint32, fragmentOffset uint32, blockSizes []uint32) (string, error) {
+	var contents []byte
+
+	pos := blocksStart
+	for _, blockSize := range blockSizes {
+		length := uint64(blockSize &^ squashfsDataUncompressed)
+		block := fs.data[pos : pos+length]
+		if blockSize&squashfsDataUncompressed == 0 {
+			var err error
+			block, err = testDecompress(block)
+			if err != nil {
+				return "", fmt.Errorf("failed to decompress block at %d: %w", pos, err)
+			}
+		}
+
+		contents = append(contents, block...)
+		pos += length
+	}
+
+	if fragment != squashfsInvalid {
+		var entry struct {
+			Start  uint64
+			Size   uint32
+			Unused uint32
+		}
+		if err := fs.lookupTable(fs.superblock.FragmentTableStart, uint64(fragment), &entry); err != nil {
+			return "", err
+		}
+
+		length := uint64(entry.Size &^ squashfsDataUncompressed)
+		block := fs.data[entry.Start : entry.Start+length]
+		if entry.Size&squashfsDataUncompressed == 0 {
+			var err error
+			block, err = testDecompress(block)
+			if err != nil {
+				return "", fmt.Errorf("failed to decompress fragment %d: %w", fragment, err)
+			}
+		}
+
+		tail := size - uint64(len(contents))
+		contents = append(contents, block[fragmentOffset:uint64(fragmentOffset)+tail]...)
+	}
+
+	if uint64(len(contents)) != size {
+		return "", fmt.Errorf("read %d bytes, expected %d", len(contents), size)
+	}
+
+	return string(contents), nil
+}
+
+// readInode decodes the inode at `ref`. Directories return where their
+// listing is.
+func (fs *testSquashfs) readInode(ref uint64) (*testSquashfsEntry, uint64, uint32, error) {
+	m, err := fs.metadata(fs.superblock.InodeTableStart, ref)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	var header squashfsInodeHeader
+	if err := binary.Read(m, binary.LittleEndian, &header); err != nil {
+		return nil, 0, 0, err
+	}
+
+	entry := &testSquashfsEntry{
+		mode:   int64(header.Mode),
+		number: header.Number,
+	}
+	if entry.uid, err = fs.id(header.Uid); err != nil {
+		return nil, 0, 0, err
+	}
+	if entry.gid, err = fs.id(header.Gid); err != nil {
+		return nil, 0, 0, err
+	}
+
+	read := func(data ...any) {
+		for _, d := range data {
+			if err == nil {
+				err = binary.Read(m, binary.LittleEndian, d)
+			}
+		}
+	}
+
+	xattr := uint32(squashfsInvalid)
+	var listingRef uint64
+	var listingSize uint32
+
+	switch header.Type {
+	case squashfsTypeDir:
+		var startBlock, parent uint32
+		var fileSize, offset uint16
+		read(&startBlock, &entry.nlink, &fileSize, &offset, &parent)
+		entry.typeflag = tar.TypeDir
+		listingRef = uint64(startBlock)<<16 | uint64(offset)
+		listingSize = uint32(fileSize)
+	case squashfsTypeDir + squashfsTypeExtended:
+		var startBlock, parent uint32
+		var indexCount, offset uint16
+		read(&entry.nlink, &listingSize, &startBlock, &parent, &indexCount, &offset, &xattr)
+		entry.typeflag = tar.TypeDir
+		listingRef = uint64(startBlock)<<16 | uint64(offset)
+	case squashfsTypeFile, squashfsTypeFile + squashfsTypeExtended:
+		var blocksStart, size uint64
+		var fragment, fragmentOffset uint32
+		if header.Type == squashfsTypeFile {
+			var start32, size32 uint32
+			read(&start32, &fragment, &fragmentOffset, &size32)
+			blocksStart, size = uint64(start32), uint64(size32)
+			entry.nlink = 1
+		} else {
+			var sparse uint64
+			read(&blocksStart, &size, &sparse, &entry.nlink, &fragment, &fragmentOffset, &xattr)
+		}
+		if err != nil {
+			return nil, 0, 0, err
+		}
+
+		count := size / squashfsBlockSize
+		if fragment == squashfsInvalid && size%squashfsBlockSize != 0 {
+			count++
+		}
+		blockSizes := make([]uint32, count)
+		read(blockSizes)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+
+		entry.typeflag = tar.TypeReg
+		entry.contents, err = fs.fileContents(blocksStart, size, fragment, fragmentOffset, blockSizes)
+	case squashfsTypeSymlink, squashfsTypeSymlink + squashfsTypeExtended:
+		var size uint32
+		read(&entry.nlink, &size)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		target := make([]byte, size)
+		_, err = io.ReadFull(m, target)
+		if header.Type != squashfsTypeSymlink {
+			read(&xattr)
+		}
+		entry.typeflag = tar.TypeSymlink
+		entry.linkname = string(target)
+	case squashfsTypeBlock, squashfsTypeChar, squashfsTypeBlock + squashfsTypeExtended, squashfsTypeChar + squashfsTypeExtended:
+		var dev uint32
+		read(&entry.nlink, &dev)
+		if header.Type >= squashfsTypeExtended {
+			read(&xattr)
+		}
+		entry.typeflag = tar.TypeChar
+		if header.Type%squashfsTypeExtended == squashfsTypeBlock {
+			entry.typeflag = tar.TypeBlock
+		}
+		entry.devmajor = int64((dev >> 8) & 0xFFF)
+		entry.devminor = int64(dev&0xFF | (dev>>12)&^0xFF)
+	case squashfsTypeFifo, squashfsTypeFifo + squashfsTypeExtended:
+		read(&entry.nlink)
+		if header.Type != squashfsTypeFifo {
+			read(&xattr)
+		}
+		entry.typeflag = tar.TypeFifo
+	default:
+		return nil, 0, 0, fmt.Errorf("unsupported inode type %d", header.Type)
+	}
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	entry.xattrs, err = fs.xattrs(xattr)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	return entry, listingRef, listingSize, nil
+}
+
+// walk decodes the directory at `ref` and everything below it into `entries`
+func (fs *testSquashfs) walk(name string, ref uint64, entries map[string]*testSquashfsEntry) error {
+	entry, listingRef, listingSize, err := fs.readInode(ref)
+	if err != nil {
+		return fmt.Errorf("`%s`: %w", name, err)
+	}
+	entries[name] = entry
+	if entry.typeflag != tar.TypeDir {
+		return nil
+	}
+
+	// the size includes the implicit `.` and `..` entries
+	remaining := int(listingSize) - 3
+	if remaining <= 0 {
+		return nil
+	}
+
+	m, err := fs.metadata(fs.superblock.DirectoryTableStart, listingRef)
+	if err != nil {
+		return err
+	}
+
+	for remaining > 0 {
+		var header struct {
+			Count  uint32
+			Start  uint32
+			Number uint32
+		}
+		if err := binary.Read(m, binary.LittleEndian, &header); err != nil {
+			return err
+		}
+		remaining -= 12
+
+		// the kernel rejects headers with more entries
+		if header.Count >= 256 {
+			return fmt.Errorf("`%s` has a header with %d entries", name, header.Count+1)
+		}
+
+		for i := uint32(0); i <= header.Count; i++ {
+			var dirEntry struct {
+				Offset   uint16
+				Number   int16
+				Type     uint16
+				NameSize uint16
+			}
+			if err := binary.Read(m, binary.LittleEndian, &dirEntry); err != nil {
+				return err
+			}
+			childName := make([]byte, dirEntry.NameSize+1)
+			if _, err := io.ReadFull(m, childName); err != nil {
+				return err
+			}
+			remaining -= 8 + len(childName)
+
+			childRef := uint64(header.Start)<<16 | uint64(dirEntry.Offset)
+			err := fs.walk(path.Join(name, string(childName)), childRef, entries)
+			if err != nil {
+				return err
+			}
+
+			child := entries[path.Join(name, string(childName))]
+			if child.number != uint32(int64(header.Number)+int64(dirEntry.Number)) {
+				return fmt.Errorf("`%s` has inode number %d in its parent, but %d in its inode", childName, uint32(int64(header.Number)+int64(dirEntry.Number)), child.number)
+			}
+		}
+	}
+
+	return nil
+}
+
+func readTestSquashfs(t *testing.T, data []byte) map[string]*testSquashfsEntry {
+	t.Helper()
+
+	fs := &testSquashfs{data: data}
+	err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &fs.superblock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fs.superblock.Magic != squashfsMagic {
+		t.Fatalf("invalid magic %x", fs.superblock.Magic)
+	}
+	if len(data)%4096 != 0 {
+		t.Errorf("size %d isn't a multiple of 4K", len(data))
+	}
+
+	entries := map[string]*testSquashfsEntry{}
+	err = fs.walk(".", fs.superblock.RootInode, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uint32(len(uniqueInodes(entries))) != fs.superblock.InodeCount {
+		t.Errorf("found %d inodes, the superblock says %d", len(uniqueInodes(entries)), fs.superblock.InodeCount)
+	}
+
+	return entries
+}
+
+func uniqueInodes(entries map[string]*testSquashfsEntry) map[uint32]bool {
+	numbers := map[uint32]bool{}
+	for _, entry := range entries {
+		numbers[entry.number] = true
+	}
+
+	return numbers
+}
+
+// writeTestSquashfs writes `headers` with the contents of regular files in
+// `contents`
+func writeTestSquashfs(t *testing.T, headers []*tar.Header, contents map[string]string) ([]byte, error) {
+	t.Helper()
+
+	file, err := os.Create(filepath.Join(t.TempDir(), "rootfs.squashfs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	sw, err := NewSquashfsWriter(zap.NewNop().Sugar(), file, "gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeErr := func() error {
+		for _, header := range headers {
+			if err := sw.WriteHeader(header); err != nil {
+				return err
+			}
+			if data, ok := contents[header.Name]; ok {
+				if _, err := io.WriteString(sw, data); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}()
+	closeErr := sw.Close()
+	if writeErr == nil {
+		writeErr = closeErr
+	}
+
+	data, err := os.ReadFile(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data, writeErr
+}
+
+func TestSquashfsRoundTrip(t *testing.T) {
+	big := strings.Repeat("0123456789abcdef", 3*squashfsBlockSize/16+100)
+	contents := map[string]string{
+		"etc/hostname": "lxdocker\n",
+		"usr/big":      big,
+		"acl":          "acl",
+	}
+
+	headers := []*tar.Header{
+		{Typeflag: tar.TypeXGlobalHeader, Name: "pax_global_header", PAXRecords: map[string]string{"comment": "ignored"}},
+		{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0750, Uid: 1000, Gid: 1001, PAXRecords: map[string]string{"SCHILY.xattr.user.dir": "yes"}},
+		{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0644, Size: int64(len(contents["etc/hostname"]))},
+		{Typeflag: tar.TypeLink, Name: "etc/hostname.link", Linkname: "etc/hostname"},
+		{Typeflag: tar.TypeReg, Name: "usr/big", Mode: 04755, Uid: 65534, Size: int64(len(big)), PAXRecords: map[string]string{
+			"SCHILY.xattr.security.capability": "\x01\x00\x00\x02",
+			"SCHILY.xattr.user.comment":        "big file",
+		}},
+		{Typeflag: tar.TypeLink, Name: "usr/big.link", Linkname: "usr/big"},
+		{Typeflag: tar.TypeReg, Name: "acl", Mode: 0600, Size: 3, PAXRecords: map[string]string{
+			"SCHILY.xattr.system.posix_acl_access": "\x02\x00\x00\x00",
+			"SCHILY.xattr.trusted.kept":            "kept",
+		}},
+		{Typeflag: tar.TypeSymlink, Name: "hostname", Linkname: "etc/hostname"},
+		{Typeflag: tar.TypeSymlink, Name: "dangling", Linkname: "/does/not/exist"},
+		{Typeflag: tar.TypeChar, Name: "dev/null", Mode: 0666, Devmajor: 1, Devminor: 3},
+		{Typeflag: tar.TypeBlock, Name: "dev/nvme0n1p300", Mode: 0660, Devmajor: 259, Devminor: 300},
+		{Typeflag: tar.TypeFifo, Name: "dev/fifo", Mode: 0600},
+	}
+
+	want := map[string]*testSquashfsEntry{
+		".":                 {typeflag: tar.TypeDir, mode: 0755},
+		"etc":               {typeflag: tar.TypeDir, mode: 0750, uid: 1000, gid: 1001, xattrs: map[string]string{"user.dir": "yes"}},
+		"etc/hostname":      {typeflag: tar.TypeReg, mode: 0644, nlink: 2, contents: "lxdocker\n"},
+		"etc/hostname.link": {typeflag: tar.TypeReg, mode: 0644, nlink: 2, contents: "lxdocker\n"},
+		"usr":               {typeflag: tar.TypeDir, mode: 0755},
+		"usr/big":           {typeflag: tar.TypeReg, mode: 04755, uid: 65534, nlink: 2, contents: big, xattrs: map[string]string{"security.capability": "\x01\x00\x00\x02", "user.comment": "big file"}},
+		"usr/big.link":      {typeflag: tar.TypeReg, mode: 04755, uid: 65534, nlink: 2, contents: big, xattrs: map[string]string{"security.capability": "\x01\x00\x00\x02", "user.comment": "big file"}},
+		"acl":               {typeflag: tar.TypeReg, mode: 0600, nlink: 1, contents: "acl", xattrs: map[string]string{"trusted.kept": "kept"}},
+		"hostname":          {typeflag: tar.TypeSymlink, mode: 0, nlink: 1, linkname: "etc/hostname"},
+		"dangling":          {typeflag: tar.TypeSymlink, mode: 0, nlink: 1, linkname: "/does/not/exist"},
+		"dev":               {typeflag: tar.TypeDir, mode: 0755},
+		"dev/null":          {typeflag: tar.TypeChar, mode: 0666, nlink: 1, devmajor: 1, devminor: 3},
+		"dev/nvme0n1p300":   {typeflag: tar.TypeBlock, mode: 0660, nlink: 1, devmajor: 259, devminor: 300},
+		"dev/fifo":          {typeflag: tar.TypeFifo, mode: 0600, nlink: 1},
+		"many":              {typeflag: tar.TypeDir, mode: 0755},
+	}
+
+	// more entries than fit into a single directory header. Their inodes are
+	// small enough to end up in the same metadata block, which would split
+	// the header as well.
+	for i := 0; i < 300; i++ {
+		name := fmt.Sprintf("many/fifo-%03d", i)
+		headers = append(headers, &tar.Header{Typeflag: tar.TypeFifo, Name: name, Mode: 0644})
+		want[name] = &testSquashfsEntry{typeflag: tar.TypeFifo, mode: 0644, nlink: 1}
+	}
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("many/file-%03d", i)
+		contents[name] = name
+		headers = append(headers, &tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: int64(len(name))})
+		want[name] = &testSquashfsEntry{typeflag: tar.TypeReg, mode: 0644, nlink: 1, contents: name}
+	}
+
+	data, err := writeTestSquashfs(t, headers, contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := readTestSquashfs(t, data)
+
+	for name, wantEntry := range want {
+		gotEntry, ok := got[name]
+		if !ok {
+			t.Errorf("`%s` is missing", name)
+			continue
+		}
+
+		// the writer assigns them, hardlinks are checked below
+		wantEntry.number = gotEntry.number
+		// the number of subdirectories
+		if wantEntry.typeflag == tar.TypeDir {
+			wantEntry.nlink = gotEntry.nlink
+		}
+
+		if !reflect.DeepEqual(gotEntry, wantEntry) {
+			gotEntry.contents = fmt.Sprintf("%d bytes", len(gotEntry.contents))
+			wantEntry.contents = fmt.Sprintf("%d bytes", len(wantEntry.contents))
+			t.Errorf("`%s`: got %+v, want %+v", name, *gotEntry, *wantEntry)
+		}
+	}
+	for name := range got {
+		if _, ok := want[name]; !ok {
+			t.Errorf("unexpected `%s`", name)
+		}
+	}
+
+	if got["etc/hostname"].number != got["etc/hostname.link"].number {
+		t.Errorf("hardlinks `etc/hostname` and `etc/hostname.link` have different inodes")
+	}
+	if got["usr/big"].number != got["usr/big.link"].number {
+		t.Errorf("hardlinks `usr/big` and `usr/big.link` have different inodes")
+	}
+	if got["."].nlink != 6 {
+		t.Errorf("root has %d links, want 6", got["."].nlink)
+	}
+}
+
+// TestSquashfsUnsquashfs checks the images with squashfs-tools, which doesn't
+// share any mistakes with testSquashfs
+func TestSquashfsUnsquashfs(t *testing.T) {
+	unsquashfs, err := exec.LookPath("unsquashfs")
+	if err != nil {
+		t.Skip("unsquashfs isn't installed")
+	}
+
+	big := strings.Repeat("0123456789abcdef", 3*squashfsBlockSize/16+100)
+	contents := map[string]string{
+		"etc/hostname": "lxdocker\n",
+		"usr/big":      big,
+	}
+
+	headers := []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0750, Uid: 1000, Gid: 1001},
+		{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0644, Size: int64(len(contents["etc/hostname"]))},
+		{Typeflag: tar.TypeLink, Name: "etc/hostname.link", Linkname: "etc/hostname"},
+		{Typeflag: tar.TypeReg, Name: "usr/big", Mode: 04755, Uid: 65534, Size: int64(len(big))},
+		{Typeflag: tar.TypeSymlink, Name: "hostname", Linkname: "etc/hostname"},
+		{Typeflag: tar.TypeChar, Name: "dev/null", Mode: 0666, Devmajor: 1, Devminor: 3},
+		{Typeflag: tar.TypeFifo, Name: "dev/fifo", Mode: 0600},
+	}
+
+	// path, followed by the permissions and owner, or the target of symlinks
+	want := map[string]string{
+		".":                 "drwxr-xr-x 0/0",
+		"etc":               "drwxr-x--- 1000/1001",
+		"etc/hostname":      "-rw-r--r-- 0/0",
+		"etc/hostname.link": "-rw-r--r-- 0/0",
+		"usr":               "drwxr-xr-x 0/0",
+		"usr/big":           "-rwsr-xr-x 65534/0",
+		"hostname":          "-> etc/hostname",
+		"dev":               "drwxr-xr-x 0/0",
+		"dev/null":          "crw-rw-rw- 0/0",
+		"dev/fifo":          "prw------- 0/0",
+		"many":              "drwxr-xr-x 0/0",
+	}
+	for i := 0; i < 300; i++ {
+		name := fmt.Sprintf("many/fifo-%03d", i)
+		headers = append(headers, &tar.Header{Typeflag: tar.TypeFifo, Name: name, Mode: 0644})
+		want[name] = "prw-r--r-- 0/0"
+	}
+
+	data, err := writeTestSquashfs(t, headers, contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	image := filepath.Join(dir, "rootfs.squashfs")
+	if err := os.WriteFile(image, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := exec.Command(unsquashfs, "-lln", image).CombinedOutput()
+	if err != nil {
+		t.Fatalf("unsquashfs failed: %v\n%s", err, output)
+	}
+
+	got := map[string]string{}
+	for _, line := range strings.Split(string(output), "\n") {
+		i := strings.Index(line, "squashfs-root")
+		if i < 0 {
+			continue
+		}
+
+		name := strings.TrimPrefix(strings.TrimPrefix(line[i:], "squashfs-root"), "/")
+		fields := strings.Fields(line[:i])
+		if len(fields) < 2 {
+			t.Fatalf("unexpected line `%s`", line)
+		}
+
+		if target := strings.SplitN(name, " -> ", 2); len(target) == 2 {
+			got[target[0]] = "-> " + target[1]
+		} else if name == "" {
+			got["."] = fields[0] + " " + fields[1]
+		} else {
+			got[name] = fields[0] + " " + fields[1]
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// devices can't be extracted without root
+	out := filepath.Join(dir, "out")
+	output, err = exec.Command(unsquashfs, "-no-xattrs", "-d", out, image, "etc/hostname", "etc/hostname.link", "usr/big").CombinedOutput()
+	if err != nil {
+		t.Fatalf("unsquashfs failed: %v\n%s", err, output)
+	}
+
+	for _, name := range []string{"etc/hostname", "etc/hostname.link", "usr/big"} {
+		wantContents := contents[strings.TrimSuffix(name, ".link")]
+		gotContents, err := os.ReadFile(filepath.Join(out, name))
+		if err != nil {
+			t.Error(err)
+		} else if string(gotContents) != wantContents {
+			t.Errorf("`%s` has %d bytes, want %d", name, len(gotContents), len(wantContents))
+		}
+	}
+}
+
+func TestSquashfsStopsAfterError(t *testing.T) {
+	headers := []*tar.Header{
+		{Typeflag: tar.TypeReg, Name: "file", Mode: 0644, Size: 4},
+		{Typeflag: tar.TypeGNUSparse, Name: "sparse", Mode: 0644},
+		{Typeflag: tar.TypeReg, Name: "other", Mode: 0644},
+	}
+
+	data, err := writeTestSquashfs(t, headers, map[string]string{"file": "data"})
+	if err == nil {
+		t.Fatal("writing an unsupported type succeeded")
+	}
+
+	// only the space reserved for the superblock and maybe data blocks
+	if binary.LittleEndian.Uint32(data) == squashfsMagic {
+		t.Errorf("wrote a superblock after an error")
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"go.uber.org/zap"
+)
+
+const (
+	restartNo            = "no"
+	restartOnFailure     = "on-failure"
+	restartAlways        = "always"
+	restartUnlessStopped = "unless-stopped"
+)
+
+// restart delays double after every restart up to this many seconds
+const maxRestartDelay = 60
+
+// the delay is reset if the entrypoint ran at least this many seconds
+const restartResetTime = 10
+
+// used if neither the spec nor the OCI image specify one
+const defaultStopSignal = "TERM"
+
+// the supervisor sends SIGKILL if the entrypoint didn't stop after this time
+const defaultStopTimeout = 10 * time.Second
+
+// signals which busybox' kill understands
+var signalNames = map[string]int{
+	"HUP": 1, "INT": 2, "QUIT": 3, "ILL": 4, "TRAP": 5, "ABRT": 6, "BUS": 7,
+	"FPE": 8, "KILL": 9, "USR1": 10, "SEGV": 11, "USR2": 12, "PIPE": 13,
+	"ALRM": 14, "TERM": 15, "STKFLT": 16, "CHLD": 17, "CONT": 18, "STOP": 19,
+	"TSTP": 20, "TTIN": 21, "TTOU": 22, "URG": 23, "XCPU": 24, "XFSZ": 25,
+	"VTALRM": 26, "PROF": 27, "WINCH": 28, "IO": 29, "PWR": 30, "SYS": 31,
+}
+
+// parseStopSignal translates signals like `SIGQUIT`, `quit` or `3`, as used
+// by docker, to the name busybox' kill expects
+func parseStopSignal(s string) (string, error) {
+	if number, err := strconv.Atoi(s); err == nil {
+		for name, n := range signalNames {
+			if n == number {
+				return name, nil
+			}
+		}
+
+		return "", fmt.Errorf("unsupported stop signal `%s`", s)
+	}
+
+	name := strings.TrimPrefix(strings.ToUpper(s), "SIG")
+	if _, ok := signalNames[name]; !ok {
+		return "", fmt.Errorf("unsupported stop signal `%s`", s)
+	}
+
+	return name, nil
+}
+
+type restartPolicy struct {
+	name string
+	// maximum number of restarts for `on-failure`, 0 means unlimited
+	max int
+}
+
+// parseRestartPolicy parses the docker-style `restart` option of a spec
+func parseRestartPolicy(s string) (restartPolicy, error) {
+	name, max, hasMax := strings.Cut(s, ":")
+
+	switch name {
+	case "":
+		return restartPolicy{name: restartNo}, nil
+	case restartNo, restartAlways, restartUnlessStopped:
+		if hasMax {
+			return restartPolicy{}, fmt.Errorf("restart policy `%s` doesn't support a maximum", name)
+		}
+
+		// the entrypoint can't be stopped without stopping the container
+		if name == restartUnlessStopped {
+			name = restartAlways
+		}
+
+		return restartPolicy{name: name}, nil
+	case restartOnFailure:
+		policy := restartPolicy{name: name}
+		if hasMax {
+			var err error
+			policy.max, err = strconv.Atoi(max)
+			if err != nil || policy.max < 0 {
+				return restartPolicy{}, fmt.Errorf("invalid maximum number of restarts `%s`", max)
+			}
+		}
+
+		return policy, nil
+	}
+
+	return restartPolicy{}, fmt.Errorf("unknown restart policy `%s`", s)
+}
+
+// docker's defaults for healthchecks
+const (
+	defaultHealthInterval = 30 * time.Second
+	defaultHealthTimeout  = 30 * time.Second
+	defaultHealthRetries  = 3
+)
+
+// where the supervisor writes the result of the healthcheck
+const healthFile = "/run/lxdocker/health"
+
+type supervisorConfig struct {
+	restart     restartPolicy
+	stopSignal  string
+	stopTimeout time.Duration
+	// nil if the image doesn't have a healthcheck
+	healthcheck      *v1.HealthConfig
+	restartUnhealthy bool
+}
+
+func newSupervisorConfig(log *zap.SugaredLogger, config *v1.Config, spec ImageSpec) (supervisorConfig, error) {
+	policy, err := parseRestartPolicy(spec.Restart)
+	if err != nil {
+		return supervisorConfig{}, err
+	}
+
+	supervisor := supervisorConfig{
+		restart:          policy,
+		stopSignal:       defaultStopSignal,
+		stopTimeout:      defaultStopTimeout,
+		restartUnhealthy: spec.RestartUnhealthy,
+	}
+
+	if config.StopSignal != "" {
+		supervisor.stopSignal, err = parseStopSignal(config.StopSignal)
+		if err != nil {
+			log.Warnf("ignore stop signal of the image: %v", err)
+			supervisor.stopSignal = defaultStopSignal
+		}
+	}
+	if spec.StopSignal != "" {
+		supervisor.stopSignal, err = parseStopSignal(spec.StopSignal)
+		if err != nil {
+			return supervisorConfig{}, err
+		}
+	}
+
+	if spec.StopTimeout > 0 {
+		supervisor.stopTimeout = spec.StopTimeout
+	}
+
+	supervisor.healthcheck = getHealthcheck(config)
+
+	return supervisor, nil
+}
+
+// getHealthcheck returns the healthcheck of the image with docker's defaults
+// applied, or nil if there's none
+func getHealthcheck(config *v1.Config) *v1.HealthConfig {
+	if config.Healthcheck == nil || len(config.Healthcheck.Test) == 0 {
+		return nil
+	}
+
+	switch config.Healthcheck.Test[0] {
+	case "CMD", "CMD-SHELL":
+	default:
+		// that's `NONE` or something we don't know
+		return nil
+	}
+
+	healthcheck := *config.Healthcheck
+	if healthcheck.Interval <= 0 {
+		healthcheck.Interval = defaultHealthInterval
+	}
+	if healthcheck.Timeout <= 0 {
+		healthcheck.Timeout = defaultHealthTimeout
+	}
+	if healthcheck.Retries <= 0 {
+		healthcheck.Retries = defaultHealthRetries
+	}
+
+	return &healthcheck
+}
+
+// seconds rounds up, since busybox might not support fractional sleeps
+func seconds(duration time.Duration) int {
+	return int((duration + time.Second - 1) / time.Second)
+}
+
+// writeInitHealthcheck writes a function which runs the healthcheck in the
+// background as the user of the entrypoint and writes the result to
+// `healthFile`. If `restart` is set, it
+// sends SIGUSR1 to the supervisor when the entrypoint becomes unhealthy.
+func writeInitHealthcheck(data *bytes.Buffer, healthcheck *v1.HealthConfig, restart bool) {
+	_, err := fmt.Fprintf(data, "lxdocker_healthcheck() {\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\tlxdocker_health_start=\"$(/busybox-lxd date +%%s)\"; lxdocker_health_failures=0\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\techo starting > %s\n", healthFile)
+	check(err)
+	_, err = fmt.Fprintf(data, "\twhile true; do\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\t\t/busybox-lxd sleep %d\n", seconds(healthcheck.Interval))
+	check(err)
+
+	// as the user of the entrypoint
+	_, err = fmt.Fprintf(data, "\t\tif (lxdocker_exec /busybox-lxd timeout -s KILL %d", seconds(healthcheck.Timeout))
+	check(err)
+	if healthcheck.Test[0] == "CMD-SHELL" {
+		_, err = fmt.Fprintf(data, " /bin/sh -c %s", shellQuote(strings.Join(healthcheck.Test[1:], " ")))
+		check(err)
+	} else {
+		for _, arg := range healthcheck.Test[1:] {
+			_, err = fmt.Fprintf(data, " \"%s\"", shellEscape(arg))
+			check(err)
+		}
+	}
+	_, err = fmt.Fprintf(data, ") </dev/null >/dev/null 2>&1; then\n")
+	check(err)
+
+	_, err = fmt.Fprintf(data, "\t\t\tlxdocker_health_failures=0; echo healthy > %s\n", healthFile)
+	check(err)
+	_, err = fmt.Fprintf(data, "\t\t\tcontinue\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\t\tfi\n")
+	check(err)
+	// failures during the start period don't count
+	_, err = fmt.Fprintf(data, "\t\t[ $(($(/busybox-lxd date +%%s) - lxdocker_health_start)) -lt %d ] && continue\n", seconds(healthcheck.StartPeriod))
+	check(err)
+	_, err = fmt.Fprintf(data, "\t\tlxdocker_health_failures=$((lxdocker_health_failures + 1))\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\t\t[ \"$lxdocker_health_failures\" -lt %d ] && continue\n", healthcheck.Retries)
+	check(err)
+	_, err = fmt.Fprintf(data, "\t\techo unhealthy > %s\n", healthFile)
+	check(err)
+	if restart {
+		_, err = fmt.Fprintf(data, "\t\tkill -USR1 $$\n")
+		check(err)
+	}
+	_, err = fmt.Fprintf(data, "\t\tlxdocker_health_start=\"$(/busybox-lxd date +%%s)\"; lxdocker_health_failures=0\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\tdone\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "}\n")
+	check(err)
+}
+
+// writeInitSupervisor writes the part of the init script that runs the
+// entrypoint in the background and restarts it according to the restart
+// policy. The number of times it exited with an error is written to
+// /run/lxdocker/crashes.
+// On shutdown, the entrypoint gets the stop signal and is killed if it's still
+// running after the stop timeout.
+func writeInitSupervisor(data *bytes.Buffer, supervisor supervisorConfig) {
+	_, err := fmt.Fprintf(data, "/busybox-lxd mkdir -p /run/lxdocker\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "lxdocker_crashes=0; echo 0 > /run/lxdocker/crashes\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "lxdocker_stopping=\"\"; lxdocker_unhealthy=\"\"; lxdocker_child=\"\"; lxdocker_killer=\"\"; lxdocker_sleep=\"\"; lxdocker_delay=1\n")
+	check(err)
+
+	// without job control, the shell starts background processes with SIGINT
+	// and SIGQUIT ignored, and `trap -` can't undo that. That only works if
+	// we have a controlling terminal though, so tell the user when the
+	// entrypoint might not react to them.
+	_, err = fmt.Fprintf(data, "set -m 2>/dev/null || echo \"lxdocker: no job control, the entrypoint starts with SIGINT and SIGQUIT ignored\" >&2\n")
+	check(err)
+
+	_, err = fmt.Fprintf(data, "lxdocker_kill_child() {\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\t[ -z \"$lxdocker_child\" ] && return\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\tkill -%s \"$lxdocker_child\" 2>/dev/null\n", supervisor.stopSignal)
+	check(err)
+	_, err = fmt.Fprintf(data, "\t[ -n \"$lxdocker_killer\" ] && return\n")
+	check(err)
+	// don't let `lxc stop` wait for LXD's timeout. The killer gets stopped
+	// once the entrypoint exited, so it can't hit a restarted one.
+	_, err = fmt.Fprintf(data, "\t(trap 'kill \"$lxdocker_timer\" 2>/dev/null; wait \"$lxdocker_timer\"; exit' TERM; /busybox-lxd sleep %d & lxdocker_timer=$!; wait \"$lxdocker_timer\"; kill -9 \"$lxdocker_child\" 2>/dev/null) &\n", seconds(supervisor.stopTimeout))
+	check(err)
+	_, err = fmt.Fprintf(data, "\tlxdocker_killer=$!\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "}\n")
+	check(err)
+
+	// stop the child if we receive SIGPWR
+	// this makes `lxc stop` work. It also interrupts waiting for a restart.
+	_, err = fmt.Fprintf(data, "lxdocker_stop() {\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\tlxdocker_stopping=1\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\t[ -n \"$lxdocker_sleep\" ] && kill \"$lxdocker_sleep\" 2>/dev/null\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\tlxdocker_kill_child\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "}\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "trap lxdocker_stop PWR\n")
+	check(err)
+
+	if supervisor.healthcheck != nil {
+		writeInitHealthcheck(data, supervisor.healthcheck, supervisor.restartUnhealthy)
+
+		if supervisor.restartUnhealthy {
+			_, err = fmt.Fprintf(data, "trap 'lxdocker_unhealthy=1; lxdocker_kill_child' USR1\n")
+			check(err)
+		}
+
+		_, err = fmt.Fprintf(data, "lxdocker_healthcheck &\n")
+		check(err)
+	}
+
+	_, err = fmt.Fprintf(data, "while true; do\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\tlxdocker_start=\"$(/busybox-lxd date +%%s)\"\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\tlxdocker_exec \"$@\" </dev/null &\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\tlxdocker_child=$!\n")
+	check(err)
+	// wait returns early if we receive a trapped signal, so wait until the
+	// child is really gone
+	_, err = fmt.Fprintf(data, "\twhile true; do\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\t\twait \"$lxdocker_child\"; lxdocker_status=$?\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\t\tkill -0 \"$lxdocker_child\" 2>/dev/null || break\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\tdone\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\tlxdocker_child=\"\"\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\tif [ -n \"$lxdocker_killer\" ]; then\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\t\tkill \"$lxdocker_killer\" 2>/dev/null; wait \"$lxdocker_killer\"; lxdocker_killer=\"\"\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\tfi\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\t[ -n \"$lxdocker_stopping\" ] && exit \"$lxdocker_status\"\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\tif [ \"$lxdocker_status\" -ne 0 ]; then\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\t\tlxdocker_crashes=$((lxdocker_crashes + 1)); echo \"$lxdocker_crashes\" > /run/lxdocker/crashes\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\tfi\n")
+	check(err)
+
+	// unhealthy entrypoints are restarted regardless of the policy
+	_, err = fmt.Fprintf(data, "\tif [ -n \"$lxdocker_unhealthy\" ]; then\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\t\tlxdocker_unhealthy=\"\"\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\telse\n")
+	check(err)
+
+	switch supervisor.restart.name {
+	case restartNo:
+		_, err = fmt.Fprintf(data, "\t\texit \"$lxdocker_status\"\n")
+		check(err)
+	case restartOnFailure:
+		_, err = fmt.Fprintf(data, "\t\t[ \"$lxdocker_status\" -eq 0 ] && exit 0\n")
+		check(err)
+		if supervisor.restart.max > 0 {
+			_, err = fmt.Fprintf(data, "\t\t[ \"$lxdocker_crashes\" -gt %d ] && exit \"$lxdocker_status\"\n", supervisor.restart.max)
+			check(err)
+		}
+	}
+
+	_, err = fmt.Fprintf(data, "\t\t:\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\tfi\n")
+	check(err)
+
+	_, err = fmt.Fprintf(data, "\t[ $(($(/busybox-lxd date +%%s) - lxdocker_start)) -ge %d ] && lxdocker_delay=1\n", restartResetTime)
+	check(err)
+	_, err = fmt.Fprintf(data, "\techo \"lxdocker: entrypoint exited with status $lxdocker_status, restart in ${lxdocker_delay}s\" >&2\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\t/busybox-lxd sleep \"$lxdocker_delay\" & lxdocker_sleep=$!\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\twait \"$lxdocker_sleep\"; lxdocker_sleep=\"\"\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\t[ -n \"$lxdocker_stopping\" ] && exit \"$lxdocker_status\"\n")
+	check(err)
+	_, err = fmt.Fprintf(data, "\tlxdocker_delay=$((lxdocker_delay * 2)); [ \"$lxdocker_delay\" -gt %d ] && lxdocker_delay=%d\n", maxRestartDelay, maxRestartDelay)
+	check(err)
+	_, err = fmt.Fprintf(data, "done\n")
+	check(err)
+}
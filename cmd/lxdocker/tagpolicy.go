@@ -0,0 +1,365 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"go.uber.org/zap"
+)
+
+// TagPolicy selects the tag of `image` from the tags in the registry
+type TagPolicy struct {
+	// constraint like `^1.4`, `~1.4.2` or `>=1.2, <2`
+	Semver string
+	// only use matching tags. If it has a capture group, the first one is
+	// used as the version.
+	Regex string
+	// use the tag with the highest numbers, like `20220815` or `1.4.2`
+	NewestNumeric bool `yaml:"newest_numeric"`
+}
+
+var semverRegexp = regexp.MustCompile(`^v?(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)(-[0-9A-Za-z.-]+)?(\+[0-9A-Za-z.-]+)?$`)
+var numericRegexp = regexp.MustCompile(`^[0-9]+(\.[0-9]+)*$`)
+var numberRegexp = regexp.MustCompile(`[0-9]+`)
+
+type semver struct {
+	major, minor, patch uint64
+}
+
+func (v semver) compare(other semver) int {
+	switch {
+	case v.major != other.major:
+		return compareUint(v.major, other.major)
+	case v.minor != other.minor:
+		return compareUint(v.minor, other.minor)
+	default:
+		return compareUint(v.patch, other.patch)
+	}
+}
+
+func compareUint(a uint64, b uint64) int {
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
+}
+
+// parseSemver parses release versions. Pre-releases are ignored, since tags
+// like `1.4.2-alpine` are usually variants and not pre-releases.
+func parseSemver(s string) (semver, bool) {
+	match := semverRegexp.FindStringSubmatch(s)
+	if match == nil || match[4] != "" {
+		return semver{}, false
+	}
+
+	var v semver
+	var err error
+	for i, part := range []*uint64{&v.major, &v.minor, &v.patch} {
+		*part, err = strconv.ParseUint(match[i+1], 10, 64)
+		if err != nil {
+			return semver{}, false
+		}
+	}
+
+	return v, true
+}
+
+// semverBound is a single comparison like `>=1.4.0`
+type semverBound struct {
+	op      string
+	version semver
+}
+
+func (bound semverBound) matches(v semver) bool {
+	result := v.compare(bound.version)
+
+	switch bound.op {
+	case ">":
+		return result > 0
+	case ">=":
+		return result >= 0
+	case "<":
+		return result < 0
+	case "<=":
+		return result <= 0
+	default:
+		return result == 0
+	}
+}
+
+// semverConstraint matches if all bounds of any of its alternatives match
+type semverConstraint [][]semverBound
+
+func (constraint semverConstraint) matches(v semver) bool {
+	for _, bounds := range constraint {
+		matches := true
+		for _, bound := range bounds {
+			if !bound.matches(v) {
+				matches = false
+				break
+			}
+		}
+
+		if matches {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseSemverRange turns a single term like `^1.4` into bounds
+func parseSemverRange(term string) ([]semverBound, error) {
+	op := ""
+	for _, prefix := range []string{">=", "<=", ">", "<", "=", "^", "~"} {
+		if strings.HasPrefix(term, prefix) {
+			op = prefix
+			break
+		}
+	}
+	s := strings.TrimPrefix(strings.TrimSpace(strings.TrimPrefix(term, op)), "v")
+	if s == "" {
+		return nil, fmt.Errorf("missing version in `%s`", term)
+	}
+
+	// missing and wildcard parts are zero, `n` is the number of given parts
+	parts := [3]uint64{}
+	n := 0
+	for i, part := range strings.Split(s, ".") {
+		if i >= 3 {
+			return nil, fmt.Errorf("invalid version `%s`", term)
+		}
+		if part == "x" || part == "X" || part == "*" {
+			break
+		}
+
+		number, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version `%s`", term)
+		}
+
+		parts[i] = number
+		n++
+	}
+
+	lower := semver{parts[0], parts[1], parts[2]}
+	// the first version that doesn't match the given parts anymore
+	next := func(index int) semver {
+		switch index {
+		case 0:
+			return semver{lower.major + 1, 0, 0}
+		case 1:
+			return semver{lower.major, lower.minor + 1, 0}
+		default:
+			return semver{lower.major, lower.minor, lower.patch + 1}
+		}
+	}
+
+	switch op {
+	case ">", ">=", "<", "<=":
+		return []semverBound{{op, lower}}, nil
+	case "^":
+		// the first non-zero part may not change
+		index := 0
+		for index < n-1 && parts[index] == 0 {
+			index++
+		}
+		return []semverBound{{">=", lower}, {"<", next(index)}}, nil
+	case "~":
+		if n <= 1 {
+			return []semverBound{{">=", lower}, {"<", next(0)}}, nil
+		}
+		return []semverBound{{">=", lower}, {"<", next(1)}}, nil
+	default:
+		if n == 0 {
+			return []semverBound{}, nil
+		}
+		if n == 3 {
+			return []semverBound{{"=", lower}}, nil
+		}
+		return []semverBound{{">=", lower}, {"<", next(n - 1)}}, nil
+	}
+}
+
+// parseSemverConstraint parses constraints like `>=1.2, <2 || ^3`
+func parseSemverConstraint(s string) (semverConstraint, error) {
+	constraint := semverConstraint{}
+
+	for _, alternative := range strings.Split(s, "||") {
+		// allow `>= 1.2` as well as `>=1.2 <2`
+		terms := []string{}
+		for _, field := range strings.Fields(strings.ReplaceAll(alternative, ",", " ")) {
+			if len(terms) > 0 && strings.Trim(terms[len(terms)-1], "<>=^~") == "" {
+				terms[len(terms)-1] += field
+				continue
+			}
+			terms = append(terms, field)
+		}
+		if len(terms) == 0 {
+			return nil, fmt.Errorf("empty semver constraint in `%s`", s)
+		}
+
+		bounds := []semverBound{}
+		for _, term := range terms {
+			termBounds, err := parseSemverRange(term)
+			if err != nil {
+				return nil, err
+			}
+
+			bounds = append(bounds, termBounds...)
+		}
+
+		constraint = append(constraint, bounds)
+	}
+
+	return constraint, nil
+}
+
+// compareNumbers compares the numbers in two strings from left to right
+func compareNumbers(a string, b string) int {
+	numbersA := numberRegexp.FindAllString(a, -1)
+	numbersB := numberRegexp.FindAllString(b, -1)
+
+	for i := 0; i < len(numbersA) && i < len(numbersB); i++ {
+		// compare them as strings, so they can't overflow
+		x := strings.TrimLeft(numbersA[i], "0")
+		y := strings.TrimLeft(numbersB[i], "0")
+		if len(x) != len(y) {
+			return compareUint(uint64(len(x)), uint64(len(y)))
+		}
+		if x != y {
+			return strings.Compare(x, y)
+		}
+	}
+
+	return compareUint(uint64(len(numbersA)), uint64(len(numbersB)))
+}
+
+func (policy *TagPolicy) validate() error {
+	if policy.Semver != "" && policy.NewestNumeric {
+		return fmt.Errorf("tag policies can either use semver or newest_numeric")
+	}
+	if policy.Semver == "" && policy.Regex == "" && !policy.NewestNumeric {
+		return fmt.Errorf("tag policy needs semver, regex or newest_numeric")
+	}
+
+	if policy.Semver != "" {
+		if _, err := parseSemverConstraint(policy.Semver); err != nil {
+			return fmt.Errorf("invalid semver constraint: %w", err)
+		}
+	}
+
+	if policy.Regex != "" {
+		if _, err := regexp.Compile(policy.Regex); err != nil {
+			return fmt.Errorf("invalid tag regex: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// selectTag returns the best tag according to the policy
+func (policy *TagPolicy) selectTag(tags []string) (string, error) {
+	var tagRegexp *regexp.Regexp
+	if policy.Regex != "" {
+		tagRegexp = regexp.MustCompile(policy.Regex)
+	}
+
+	var constraint semverConstraint
+	if policy.Semver != "" {
+		var err error
+		constraint, err = parseSemverConstraint(policy.Semver)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	bestTag := ""
+	bestVersion := ""
+	var bestSemver semver
+
+	for _, tag := range tags {
+		version := tag
+		if tagRegexp != nil {
+			match := tagRegexp.FindStringSubmatch(tag)
+			if match == nil {
+				continue
+			}
+			if len(match) > 1 {
+				version = match[1]
+			}
+		}
+
+		cmp := 0
+		switch {
+		case constraint != nil:
+			v, ok := parseSemver(version)
+			if !ok || !constraint.matches(v) {
+				continue
+			}
+			if bestTag != "" {
+				cmp = v.compare(bestSemver)
+			}
+			if bestTag == "" || cmp > 0 {
+				bestSemver = v
+			}
+		case policy.NewestNumeric && !numericRegexp.MatchString(version):
+			continue
+		default:
+			if bestTag != "" {
+				cmp = compareNumbers(version, bestVersion)
+			}
+		}
+
+		// the tag list has no order, so break ties by name
+		if bestTag == "" || cmp > 0 || (cmp == 0 && tag > bestTag) {
+			bestTag = tag
+			bestVersion = version
+		}
+	}
+
+	if bestTag == "" {
+		return "", fmt.Errorf("no tag matches the tag policy")
+	}
+
+	return bestTag, nil
+}
+
+// resolveTag lists the tags of the spec's repository and returns the one
+// selected by its tag policy
+func resolveTag(log *zap.SugaredLogger, spec ImageSpec) (string, error) {
+	repo, err := name.NewRepository(spec.Image)
+	if err != nil {
+		return "", fmt.Errorf("parsing repository %q: %w", spec.Image, err)
+	}
+
+	// the tag is only used to find the registry
+	fetchSlots.acquire()
+	defer fetchSlots.release()
+
+	var tags []string
+	err = remoteDo(log, repo.Tag("latest"), spec, func(ref name.Reference, opts ...remote.Option) error {
+		var err error
+		tags, err = remote.List(ref.Context(), opts...)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to list tags of `%s`: %w", repo.Name(), err)
+	}
+
+	tag, err := spec.TagPolicy.selectTag(tags)
+	if err != nil {
+		return "", fmt.Errorf("failed to select tag of `%s`: %w", repo.Name(), err)
+	}
+
+	log.Infof("tag policy selected `%v` of `%v`", tag, repo.Name())
+
+	return tag, nil
+}
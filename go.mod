@@ -22,7 +22,6 @@ require (
 	github.com/gorilla/websocket v1.5.0 // indirect
 	github.com/inconshreveable/mousetrap v1.0.1 // indirect
 	github.com/kballard/go-shellquote v0.0.0-20180428030007-95032a82bc51 // indirect
-	github.com/klauspost/compress v1.15.9 // indirect
 	github.com/mitchellh/go-homedir v1.1.0 // indirect
 	github.com/opencontainers/go-digest v1.0.0 // indirect
 	github.com/pborman/uuid v1.2.1 // indirect
@@ -39,7 +38,9 @@ require (
 )
 
 require (
+	github.com/klauspost/compress v1.15.9
 	github.com/spf13/cobra v1.5.0
+	github.com/ulikunitz/xz v0.5.15
 	pkg/common v1.0.0
 )
 
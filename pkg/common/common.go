@@ -1,18 +1,24 @@
 package common
 
 import (
+	"errors"
 	"fmt"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"golang.org/x/term"
+	"io"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"syscall"
+	"time"
 
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"gopkg.in/yaml.v3"
 )
 
-type RootfsMetadata struct {
+type RootfsVersion struct {
 	// these two combined let us check if we need to regenerate
 	SpecDigest     v1.Hash
 	OciImageDigest v1.Hash
@@ -21,6 +27,36 @@ type RootfsMetadata struct {
 	LxdImageDigest v1.Hash
 	// path to the rootfs
 	Filename string
+	// zero for metadata written by older versions of lxdocker
+	Created time.Time `yaml:",omitempty"`
+	// cache key of the layer generated by the build steps of the spec
+	RunLayer string `yaml:",omitempty"`
+	// tag selected by the tag policy of the spec
+	Tag string `yaml:",omitempty"`
+	// digest the reference resolved to in the registry, which is the index
+	// for multi-platform images. Zero for metadata written by older versions
+	// of lxdocker.
+	RemoteDigest v1.Hash `yaml:",omitempty"`
+}
+
+type RootfsMetadata struct {
+	// name of the spec, empty for metadata written by older versions of
+	// lxdocker. Use the filename in that case.
+	Name string `yaml:",omitempty"`
+	// OCI platform of the image, empty for metadata written by older
+	// versions of lxdocker. Those always use the platform of the host.
+	Platform string `yaml:",omitempty"`
+
+	// the current version
+	RootfsVersion `yaml:",inline"`
+
+	// previous versions which are still available, newest first
+	History []RootfsVersion `yaml:",omitempty"`
+}
+
+// Versions returns all available versions, newest first
+func (metadata *RootfsMetadata) Versions() []RootfsVersion {
+	return append([]RootfsVersion{metadata.RootfsVersion}, metadata.History...)
 }
 
 func ReadRootfsMetaData(path string) (*RootfsMetadata, error) {
@@ -43,17 +79,163 @@ func ReadRootfsMetaData(path string) (*RootfsMetadata, error) {
 	return &metadata, nil
 }
 
-func MakeLogger() *zap.SugaredLogger {
+// SpecName returns the name of the spec the metadata at `path` belongs to
+func (metadata *RootfsMetadata) SpecName(path string) string {
+	if metadata.Name != "" {
+		return metadata.Name
+	}
+
+	return strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+}
+
+// ParsePlatform returns the OCI platform of the image
+func (metadata *RootfsMetadata) ParsePlatform() (*v1.Platform, error) {
+	if metadata.Platform == "" {
+		return &v1.Platform{
+			Architecture: runtime.GOARCH,
+			OS:           runtime.GOOS,
+		}, nil
+	}
+
+	return v1.ParsePlatform(metadata.Platform)
+}
+
+func loggerConfig() zap.Config {
 	if term.IsTerminal(syscall.Stderr) {
 		config := zap.NewDevelopmentConfig()
 		config.EncoderConfig.EncodeLevel = zapcore.CapitalColorLevelEncoder
-		logger, _ := config.Build()
 
-		return logger.Sugar()
+		return config
 	} else {
-		logger, _ := zap.NewProduction()
-		defer logger.Sync()
+		return zap.NewProductionConfig()
+	}
+}
+
+func MakeLogger() *zap.SugaredLogger {
+	logger, _ := loggerConfig().Build()
+	defer logger.Sync()
+
+	return logger.Sugar()
+}
+
+// MakeWriterLogger returns a logger which formats messages like the one from
+// MakeLogger, but writes them to `w`
+func MakeWriterLogger(w io.Writer) *zap.SugaredLogger {
+	config := loggerConfig()
 
-		return logger.Sugar()
+	encoder := zapcore.NewJSONEncoder(config.EncoderConfig)
+	if config.Encoding == "console" {
+		encoder = zapcore.NewConsoleEncoder(config.EncoderConfig)
 	}
+
+	stacktraceLevel := zapcore.ErrorLevel
+	if config.Development {
+		stacktraceLevel = zapcore.WarnLevel
+	}
+
+	core := zapcore.NewCore(encoder, zapcore.AddSync(w), config.Level)
+	logger := zap.New(core, zap.AddCaller(), zap.AddStacktrace(stacktraceLevel), zap.ErrorOutput(zapcore.Lock(os.Stderr)))
+
+	return logger.Sugar()
+}
+
+// lxdocker holds this lock on both, the cache and the images directory, while
+// it's running, so multiple instances can't delete each others files
+const LockFilename = ".lxdocker.lock"
+
+// lxdocker holds this lock while it replaces metadata or deletes old images.
+// imgserver holds a shared lock while it reads them.
+const MetadataLockFilename = ".lxdocker-metadata.lock"
+
+var ErrLocked = errors.New("locked by another process")
+
+type FileLock struct {
+	file *os.File
+}
+
+// LockFile acquires a flock on `path` and creates the file if necessary.
+// Unless `wait` is true, it returns ErrLocked if somebody else holds a
+// conflicting lock.
+func LockFile(path string, exclusive bool, wait bool) (*FileLock, error) {
+	file, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file `%s`: %w", path, err)
+	}
+
+	return lockFile(file, path, exclusive, wait)
+}
+
+// LockExistingFile is like LockFile, but doesn't create the file, so it works
+// in read-only directories. The error wraps fs.ErrNotExist if there's no file.
+func LockExistingFile(path string, exclusive bool, wait bool) (*FileLock, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file `%s`: %w", path, err)
+	}
+
+	return lockFile(file, path, exclusive, wait)
+}
+
+func lockFile(file *os.File, path string, exclusive bool, wait bool) (*FileLock, error) {
+	var err error
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+
+	for {
+		err = syscall.Flock(int(file.Fd()), how)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err == syscall.EWOULDBLOCK {
+		file.Close()
+		return nil, fmt.Errorf("`%s`: %w", path, ErrLocked)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to lock `%s`: %w", path, err)
+	}
+
+	return &FileLock{file: file}, nil
+}
+
+func (lock *FileLock) Unlock() error {
+	// nothing to release if there was nothing to lock
+	if lock.file == nil {
+		return nil
+	}
+
+	// closing the file releases the lock
+	return lock.file.Close()
+}
+
+// LxdArchitecture translates an OCI platform to LXD's name of the architecture
+func LxdArchitecture(platform v1.Platform) (string, error) {
+	switch platform.Architecture {
+	case "amd64":
+		return "x86_64", nil
+	case "386":
+		return "i686", nil
+	case "arm64":
+		return "aarch64", nil
+	case "arm":
+		// LXD doesn't support anything older than ARMv7
+		if platform.Variant == "" || platform.Variant == "v7" {
+			return "armv7l", nil
+		}
+	case "ppc64le", "ppc64", "s390x", "riscv64":
+		return platform.Architecture, nil
+	case "mips64le":
+		return "mips64", nil
+	case "mipsle":
+		return "mips", nil
+	}
+
+	return "", fmt.Errorf("platform `%s` is not supported by LXD", platform.String())
 }